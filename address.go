@@ -0,0 +1,100 @@
+package ecn
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Address families, as used in address family conditions
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// parsePaddedIPv4 parses a dotted-quad IPv4 address with zero-padded octets,
+// which netip rejects. Octets are always taken to be decimal.
+func parsePaddedIPv4(s string) (netip.Addr, bool) {
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return netip.Addr{}, false
+	}
+
+	var a4 [4]byte
+	for i, octet := range octets {
+		if len(octet) == 0 || len(octet) > 3 {
+			return netip.Addr{}, false
+		}
+		n, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		a4[i] = byte(n)
+	}
+
+	return netip.AddrFrom4(a4), true
+}
+
+// canonicalize unmaps IPv4-mapped IPv6 addresses and removes zones, and
+// rejects addresses that cannot identify a host.
+func canonicalize(addr netip.Addr) (netip.Addr, error) {
+	addr = addr.Unmap().WithZone("")
+
+	if !addr.IsValid() || addr.IsUnspecified() {
+		return netip.Addr{}, fmt.Errorf("invalid address %s", addr)
+	}
+
+	return addr, nil
+}
+
+// CanonicalAddress parses an IP address as it appears in raw data and returns
+// it in canonical form, so that the same host always yields the same path
+// element: IPv4-mapped IPv6 addresses are unmapped, zones and brackets are
+// removed, and zero-padded IPv4 octets are accepted.
+func CanonicalAddress(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		var ok bool
+		if addr, ok = parsePaddedIPv4(s); !ok {
+			return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+		}
+	}
+
+	return canonicalize(addr)
+}
+
+// CanonicalIP returns an IP address from a packet or flow record in
+// canonical form, as CanonicalAddress.
+func CanonicalIP(ip net.IP) (netip.Addr, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("invalid address %v", ip)
+	}
+
+	return canonicalize(addr)
+}
+
+// AddressFamily returns the family of a canonical address.
+func AddressFamily(addr netip.Addr) string {
+	if addr.Is4() {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// FamilyConditions lists every condition FamilyCondition may return.
+var FamilyConditions = []string{
+	"ip.family." + FamilyIPv4,
+	"ip.family." + FamilyIPv6,
+}
+
+// FamilyCondition returns the condition tagging a path with the address
+// family of its target.
+func FamilyCondition(addr netip.Addr) string {
+	return "ip.family." + AddressFamily(addr)
+}
@@ -0,0 +1,88 @@
+package ecn
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCanonicalAddress(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string // empty if the address is invalid
+		family string
+	}{
+		{"192.0.2.1", "192.0.2.1", FamilyIPv4},
+		{" 192.0.2.1 ", "192.0.2.1", FamilyIPv4},
+		{"192.000.002.010", "192.0.2.10", FamilyIPv4},
+		{"::ffff:192.0.2.1", "192.0.2.1", FamilyIPv4},
+		{"[::ffff:192.0.2.1]", "192.0.2.1", FamilyIPv4},
+		{"2001:db8::1", "2001:db8::1", FamilyIPv6},
+		{"2001:DB8:0:0::1", "2001:db8::1", FamilyIPv6},
+		{"[2001:db8::1]", "2001:db8::1", FamilyIPv6},
+		{"fe80::1%eth0", "fe80::1", FamilyIPv6},
+		{"[fe80::1%eth0]", "fe80::1", FamilyIPv6},
+		{"0.0.0.0", "", ""},
+		{"::", "", ""},
+		{"::ffff:0.0.0.0", "", ""},
+		{"192.0.2.256", "", ""},
+		{"192.0.2", "", ""},
+		{"192.0.2.0001", "", ""},
+		{"example.com", "", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		addr, err := CanonicalAddress(test.in)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", test.in, addr)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%q: %s", test.in, err.Error())
+			continue
+		}
+
+		if addr.String() != test.want {
+			t.Errorf("%q: got %s, want %s", test.in, addr, test.want)
+		}
+		if AddressFamily(addr) != test.family {
+			t.Errorf("%q: family %s, want %s", test.in, AddressFamily(addr), test.family)
+		}
+		if FamilyCondition(addr) != "ip.family."+test.family {
+			t.Errorf("%q: condition %s, want ip.family.%s", test.in, FamilyCondition(addr), test.family)
+		}
+	}
+}
+
+func TestCanonicalIP(t *testing.T) {
+	tests := []struct {
+		in   net.IP
+		want string // empty if the address is invalid
+	}{
+		{net.ParseIP("192.0.2.1"), "192.0.2.1"},
+		{net.ParseIP("192.0.2.1").To4(), "192.0.2.1"},
+		{net.ParseIP("2001:db8::1"), "2001:db8::1"},
+		{net.IPv4zero, ""},
+		{net.IPv6unspecified, ""},
+		{net.IP{192, 0, 2}, ""},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		addr, err := CanonicalIP(test.in)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%v: expected error, got %s", test.in, addr)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: %s", test.in, err.Error())
+			continue
+		}
+
+		if addr.String() != test.want {
+			t.Errorf("%v: got %s, want %s", test.in, addr, test.want)
+		}
+	}
+}
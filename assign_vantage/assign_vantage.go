@@ -0,0 +1,309 @@
+// assign_vantage sets the vantage point and other keys in PTO raw metadata
+// files according to a declarative rule file. Rules match on the name of the
+// raw data file, on source addresses seen in the data (as inferred by
+// mk_metadata), and on existing metadata keys.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	ecn "github.com/mami-project/pto3-ecn"
+)
+
+// metadataSuffixes are the suffixes of metadata files, removed to get the name
+// of the raw data file a rule's filename pattern is matched against
+var metadataSuffixes = []string{".meta.json", ".pto_file_metadata.json"}
+
+// vantageRule sets metadata keys on files matching all of its conditions. A
+// rule without conditions matches every file.
+type vantageRule struct {
+	// Filename is a regular expression matched against the base name of the
+	// raw data file. Named groups may be used in values to set, as ${name}.
+	Filename string `json:"filename"`
+
+	// SourcePrefix matches files with a source address within the prefix
+	SourcePrefix string `json:"source_prefix"`
+
+	// Metadata maps metadata keys to regular expressions their values must
+	// match
+	Metadata map[string]string `json:"metadata"`
+
+	// Set maps metadata keys to the values to set
+	Set map[string]interface{} `json:"set"`
+
+	filenameRegexp *regexp.Regexp
+	sourcePrefix   netip.Prefix
+	metadataRegexp map[string]*regexp.Regexp
+}
+
+// compile checks a rule and prepares it for matching.
+func (rule *vantageRule) compile() error {
+	var err error
+
+	if len(rule.Set) == 0 {
+		return fmt.Errorf("rule sets no keys")
+	}
+
+	if rule.Filename != "" {
+		if rule.filenameRegexp, err = regexp.Compile(rule.Filename); err != nil {
+			return fmt.Errorf("bad filename pattern %s: %s", rule.Filename, err.Error())
+		}
+	}
+
+	if rule.SourcePrefix != "" {
+		if rule.sourcePrefix, err = netip.ParsePrefix(rule.SourcePrefix); err != nil {
+			return fmt.Errorf("bad source prefix %s: %s", rule.SourcePrefix, err.Error())
+		}
+		rule.sourcePrefix = rule.sourcePrefix.Masked()
+	}
+
+	rule.metadataRegexp = make(map[string]*regexp.Regexp)
+	for k, pattern := range rule.Metadata {
+		if rule.metadataRegexp[k], err = regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("bad pattern for %s %s: %s", k, pattern, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// metadataString returns a metadata value as a string for matching.
+func metadataString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// sourceAddresses returns the source addresses seen in the data of a file,
+// from the source_addresses key, or else the vantage key if it is an address.
+func sourceAddresses(keys map[string]interface{}) []netip.Addr {
+	var out []netip.Addr
+
+	if sources, ok := keys["source_addresses"].([]interface{}); ok {
+		for _, source := range sources {
+			if s, ok := source.(string); ok {
+				if addr, err := ecn.CanonicalAddress(s); err == nil {
+					out = append(out, addr)
+				}
+			}
+		}
+	} else if vantage, ok := keys["vantage"].(string); ok {
+		if addr, err := ecn.CanonicalAddress(vantage); err == nil {
+			out = append(out, addr)
+		}
+	}
+
+	return out
+}
+
+// match determines whether a rule matches a file, and returns the keys to set
+// if it does, with named groups from the filename pattern expanded.
+func (rule *vantageRule) match(rawname string, keys map[string]interface{}) (map[string]interface{}, bool) {
+	var groups []string
+
+	if rule.filenameRegexp != nil {
+		if groups = rule.filenameRegexp.FindStringSubmatch(rawname); groups == nil {
+			return nil, false
+		}
+	}
+
+	if rule.sourcePrefix.IsValid() {
+		found := false
+		for _, addr := range sourceAddresses(keys) {
+			if rule.sourcePrefix.Contains(addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	for k, re := range rule.metadataRegexp {
+		v, ok := keys[k]
+		if !ok || !re.MatchString(metadataString(v)) {
+			return nil, false
+		}
+	}
+
+	set := make(map[string]interface{})
+	for k, v := range rule.Set {
+		if s, ok := v.(string); ok && rule.filenameRegexp != nil {
+			v = os.Expand(s, func(name string) string {
+				if i := rule.filenameRegexp.SubexpIndex(name); i >= 0 {
+					return groups[i]
+				}
+				return ""
+			})
+		}
+		set[k] = v
+	}
+
+	return set, true
+}
+
+// loadRules reads a rule file, a JSON array of rules applied in order.
+func loadRules(filename string) ([]*vantageRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*vantageRule
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("cannot parse rule file %s: %s", filename, err.Error())
+	}
+
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d in %s: %s", i, filename, err.Error())
+		}
+	}
+
+	return rules, nil
+}
+
+// rawFilename returns the name of the raw data file a metadata file describes.
+func rawFilename(metafilename string) string {
+	base := filepath.Base(metafilename)
+	for _, suffix := range metadataSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return strings.TrimSuffix(base, suffix)
+		}
+	}
+	return base
+}
+
+// applyRules applies each matching rule to a metadata file in order, so later
+// rules override earlier ones. It returns the changed keys with their old and
+// new values, and writes the file unless dryRun is set.
+func applyRules(rules []*vantageRule, metafilename string, dryRun bool) ([]string, error) {
+	keys, err := ecn.ReadMetadataFile(metafilename)
+	if err != nil {
+		return nil, err
+	}
+
+	rawname := rawFilename(metafilename)
+
+	old := make(map[string]interface{})
+	for k, v := range keys {
+		old[k] = v
+	}
+
+	for _, rule := range rules {
+		if set, ok := rule.match(rawname, keys); ok {
+			for k, v := range set {
+				keys[k] = v
+			}
+		}
+	}
+
+	// determine what changed
+	var diff []string
+	for k, v := range keys {
+		ov, existed := old[k]
+		if existed && reflect.DeepEqual(ov, v) {
+			continue
+		}
+
+		nb, _ := json.Marshal(v)
+		if existed {
+			ob, _ := json.Marshal(ov)
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", k, ob, nb))
+		} else {
+			diff = append(diff, fmt.Sprintf("%s: (unset) -> %s", k, nb))
+		}
+	}
+	sort.Strings(diff)
+
+	if len(diff) == 0 || dryRun {
+		return diff, nil
+	}
+
+	return diff, ecn.WriteMetadataFile(metafilename, keys)
+}
+
+// metadataFilesIn lists the metadata files in a directory tree.
+func metadataFilesIn(dir string) ([]string, error) {
+	var out []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		for _, suffix := range metadataSuffixes {
+			if strings.HasSuffix(info.Name(), suffix) {
+				out = append(out, path)
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return out, err
+}
+
+var rulesFlag = flag.String("rules", "", "apply rules from `file`")
+var dryRunFlag = flag.Bool("n", false, "dry run: print changes without writing files")
+
+func main() {
+	flag.Parse()
+
+	if *rulesFlag == "" {
+		log.Fatal("no rule file given; use -rules")
+	}
+
+	rules, err := loadRules(*rulesFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, arg := range flag.Args() {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filenames := []string{arg}
+		if fi.IsDir() {
+			if filenames, err = metadataFilesIn(arg); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		for _, filename := range filenames {
+			diff, err := applyRules(rules, filename, *dryRunFlag)
+			if err != nil {
+				log.Fatalf("error processing %s: %s", filename, err.Error())
+			}
+
+			if len(diff) > 0 {
+				fmt.Println(filename)
+				for _, line := range diff {
+					fmt.Printf("  %s\n", line)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package ecn
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+)
+
+// Descriptor describes a normalizer or analyzer to the PTO: who owns it, how
+// to invoke it, which filetypes it reads and which conditions it generates.
+// It is serialized as the JSON file next to each tool's source.
+type Descriptor struct {
+	Owner            string   `json:"_owner"`
+	Description      string   `json:"description"`
+	RequiresMetadata []string `json:"requires_metadata,omitempty"`
+	FileTypes        []string `json:"_file_types,omitempty"`
+	Conditions       []string `json:"_conditions,omitempty"`
+	Platform         string   `json:"_platform"`
+	Invocation       string   `json:"_invocation"`
+}
+
+// DescriptorPlatform is the platform all tools in this repository run on,
+// the minimum Go release declared in goversion.go
+const DescriptorPlatform = goPlatform
+
+// DescriptorOwner owns all tools in this repository
+const DescriptorOwner = "brian@trammell.ch"
+
+// CompressedFiletypes returns each base filetype followed by its variants
+// with every supported compression suffix, since all normalizers read
+// compressed raw data.
+func CompressedFiletypes(basetypes ...string) []string {
+	suffixes := make([]string, 0, len(CompressionSuffixes))
+	for suffix := range CompressionSuffixes {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+
+	var out []string
+	for _, basetype := range basetypes {
+		out = append(out, basetype)
+		for _, suffix := range suffixes {
+			out = append(out, basetype+suffix)
+		}
+	}
+	return out
+}
+
+// Write writes a descriptor as indented JSON.
+func (d *Descriptor) Write(out io.Writer) error {
+	b, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(append(b, '\n'))
+	return err
+}
+
+// stringSet returns the strings in a JSON list as a set
+func stringSet(v interface{}) map[string]struct{} {
+	out := make(map[string]struct{})
+	list, _ := v.([]interface{})
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out[s] = struct{}{}
+		}
+	}
+	return out
+}
+
+// diffLists reports the items only in one of two JSON lists, ignoring order.
+func diffLists(key string, committed interface{}, generated interface{}) []string {
+	var out []string
+
+	committedSet := stringSet(committed)
+	generatedSet := stringSet(generated)
+
+	for item := range committedSet {
+		if _, ok := generatedSet[item]; !ok {
+			out = append(out, fmt.Sprintf("- %s: %s", key, item))
+		}
+	}
+	for item := range generatedSet {
+		if _, ok := committedSet[item]; !ok {
+			out = append(out, fmt.Sprintf("+ %s: %s", key, item))
+		}
+	}
+
+	return out
+}
+
+// Diff compares a descriptor to one read from a file, and returns the
+// differences, one per line: lines starting with - are only in the file, and
+// lines starting with + only in the descriptor. Lists are compared as sets.
+func (d *Descriptor) Diff(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var committed map[string]interface{}
+	if err := json.Unmarshal(b, &committed); err != nil {
+		return nil, fmt.Errorf("cannot parse descriptor %s: %s", filename, err.Error())
+	}
+
+	// round-trip the descriptor to compare like with like
+	if b, err = json.Marshal(d); err != nil {
+		return nil, err
+	}
+
+	var generated map[string]interface{}
+	if err := json.Unmarshal(b, &generated); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]struct{})
+	for k := range committed {
+		keys[k] = struct{}{}
+	}
+	for k := range generated {
+		keys[k] = struct{}{}
+	}
+
+	var out []string
+	for k := range keys {
+		cv, inCommitted := committed[k]
+		gv, inGenerated := generated[k]
+
+		switch {
+		case !inGenerated:
+			out = append(out, fmt.Sprintf("- %s: %v", k, cv))
+		case !inCommitted:
+			out = append(out, fmt.Sprintf("+ %s: %v", k, gv))
+		default:
+			_, cIsList := cv.([]interface{})
+			_, gIsList := gv.([]interface{})
+			if cIsList && gIsList {
+				out = append(out, diffLists(k, cv, gv)...)
+			} else if !reflect.DeepEqual(cv, gv) {
+				out = append(out, fmt.Sprintf("- %s: %v", k, cv), fmt.Sprintf("+ %s: %v", k, gv))
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out, nil
+}
+
+// DescriptorFlags are the flags common to all tools for generating and
+// checking their descriptor.
+type DescriptorFlags struct {
+	describe *bool
+	check    *string
+}
+
+// NewDescriptorFlags registers the -describe and -check-descriptor flags with
+// the flag package. It must be called before flag.Parse.
+func NewDescriptorFlags() *DescriptorFlags {
+	df := new(DescriptorFlags)
+	df.describe = flag.Bool("describe", false, "write the descriptor for this tool as JSON and exit")
+	df.check = flag.String("check-descriptor", "", "compare the descriptor for this tool to the descriptor in `file`, report differences and exit")
+	return df
+}
+
+// Requested returns true if either flag was given.
+func (df *DescriptorFlags) Requested() bool {
+	return *df.describe || *df.check != ""
+}
+
+// Run implements the describe and check modes of a tool: it writes a
+// descriptor, or the differences between it and the descriptor file given,
+// to out. It returns false if there are differences.
+func (df *DescriptorFlags) Run(d *Descriptor, out io.Writer) (bool, error) {
+	if *df.check == "" {
+		return true, d.Write(out)
+	}
+
+	diffs, err := d.Diff(*df.check)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range diffs {
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return false, err
+		}
+	}
+
+	return len(diffs) == 0, nil
+}
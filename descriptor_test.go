@@ -0,0 +1,110 @@
+package ecn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDescriptorDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "descriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Descriptor{
+		Owner:       DescriptorOwner,
+		Description: "a test normalizer",
+		FileTypes:   []string{"a", "b"},
+		Conditions:  []string{"x.y.z", "x.y.w"},
+		Platform:    "golang-1.18",
+		Invocation:  "test_normalizer",
+	}
+
+	tests := []struct {
+		name      string
+		committed string
+		want      []string
+	}{
+		{
+			name: "same, in another order",
+			committed: `{"_owner": "brian@trammell.ch", "description": "a test normalizer",
+				"_file_types": ["b", "a"], "_conditions": ["x.y.w", "x.y.z"],
+				"_platform": "golang-1.18", "_invocation": "test_normalizer"}`,
+			want: nil,
+		},
+		{
+			name: "duplicate list items",
+			committed: `{"_owner": "brian@trammell.ch", "description": "a test normalizer",
+				"_file_types": ["a", "b", "a"], "_conditions": ["x.y.w", "x.y.z"],
+				"_platform": "golang-1.18", "_invocation": "test_normalizer"}`,
+			want: nil,
+		},
+		{
+			name: "list items added and removed",
+			committed: `{"_owner": "brian@trammell.ch", "description": "a test normalizer",
+				"_file_types": ["a", "c"], "_conditions": ["x.y.z", "x.y.v"],
+				"_platform": "golang-1.18", "_invocation": "test_normalizer"}`,
+			want: []string{
+				"+ _conditions: x.y.w",
+				"+ _file_types: b",
+				"- _conditions: x.y.v",
+				"- _file_types: c",
+			},
+		},
+		{
+			name: "changed and missing values",
+			committed: `{"_owner": "brian@trammell.ch", "description": "a test normalizer",
+				"_file_types": ["a", "b"], "_conditions": ["x.y.w", "x.y.z"],
+				"_platform": "golang-1.9", "requires_metadata": ["vantage"]}`,
+			want: []string{
+				"+ _invocation: test_normalizer",
+				"+ _platform: golang-1.18",
+				"- _platform: golang-1.9",
+				"- requires_metadata: [vantage]",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		filename := filepath.Join(dir, "descriptor.json")
+		if err := ioutil.WriteFile(filename, []byte(test.committed), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := d.Diff(filename)
+		if err != nil {
+			t.Errorf("%d %s: %s", i, test.name, err.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d %s: got %q, want %q", i, test.name, got, test.want)
+		}
+	}
+}
+
+func TestDescriptorDiffBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "descriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := new(Descriptor)
+
+	if _, err := d.Diff(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected error for missing descriptor")
+	}
+
+	filename := filepath.Join(dir, "bad.json")
+	if err := ioutil.WriteFile(filename, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Diff(filename); err == nil {
+		t.Error("expected error for unparseable descriptor")
+	}
+}
@@ -1,112 +1,422 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
-	"unicode"
 
 	"github.com/colinmarc/sequencefile"
+
+	ecn "github.com/mami-project/pto3-ecn"
+	pto3 "github.com/mami-project/pto3-go"
 )
 
 var helpFlag = flag.Bool("h", false, "display a help message")
 var listFlag = flag.Bool("list", false, "list keys in file")
-var extractFlag = flag.String("extract", "", "`key` to extract from file to stdout")
+var sizesFlag = flag.Bool("sizes", false, "with -list, show the size of each value")
+var extractFlag = flag.String("extract", "", "`key` to extract from file into a file named after it")
+var catFlag = flag.String("cat", "", "`key` to extract from file to stdout")
+var globFlag = flag.String("glob", "", "only list or extract keys matching shell `pattern`")
+var regexFlag = flag.String("regex", "", "only list or extract keys matching regular expression `re`")
+var outdirFlag = flag.String("o", ".", "extract entries into `directory`")
+var indexFlag = flag.Bool("index", false, "build an index of keys for random access, for use by -extract and the normalizers")
+var mkmetaFlag = flag.Bool("mkmeta", false, "write PTO raw metadata next to each extracted entry")
+var metafileFlag = flag.String("metadata", "", "with -mkmeta, add campaign metadata from JSON `file`")
+
+// metaKeys holds metadata keys given on the command line with -set
+type metaKeys map[string]interface{}
+
+func (mk metaKeys) String() string {
+	return fmt.Sprintf("%v", map[string]interface{}(mk))
+}
+
+func (mk metaKeys) Set(kv string) error {
+	i := strings.Index(kv, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %s", kv)
+	}
+	mk[kv[:i]] = kv[i+1:]
+	return nil
+}
+
+var setKeys = make(metaKeys)
+
+func init() {
+	flag.Var(setKeys, "set", "with -mkmeta, set metadata `key=value` (may be repeated)")
+}
+
+// keySelector selects entries by key, with a glob pattern, a regular
+// expression, or both. An empty selector selects all entries.
+type keySelector struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+func newKeySelector(glob string, regex string) (*keySelector, error) {
+	ks := new(keySelector)
+
+	if glob != "" {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("bad glob %s: %s", glob, err.Error())
+		}
+		ks.glob = glob
+	}
+
+	if regex != "" {
+		var err error
+		if ks.regex, err = regexp.Compile(regex); err != nil {
+			return nil, fmt.Errorf("bad regex %s: %s", regex, err.Error())
+		}
+	}
 
-func decrapifySequenceKey(r rune) bool {
-	return unicode.IsControl(r) || unicode.IsSpace(r)
+	return ks, nil
 }
 
-func list(sf *sequencefile.Reader) error {
+func (ks *keySelector) match(k string) bool {
+	if ks.glob != "" {
+		if ok, _ := path.Match(ks.glob, k); !ok {
+			return false
+		}
+	}
+
+	if ks.regex != nil && !ks.regex.MatchString(k) {
+		return false
+	}
+
+	return true
+}
+
+// safeOutputPath returns the path within the output directory an entry is
+// extracted to. Keys may contain slashes, which are kept as subdirectories,
+// but never escape the output directory.
+func safeOutputPath(outdir string, k string) (string, error) {
+	// cleaning a rooted path removes any .. leading out of it
+	rel := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(k)), "/")
+	if rel == "" {
+		return "", fmt.Errorf("cannot extract key %q to a file", k)
+	}
+
+	return filepath.Join(outdir, filepath.FromSlash(rel)), nil
+}
+
+func list(sf *sequencefile.Reader, ks *keySelector, sizes bool) error {
 	for sf.Scan() {
-		sfk := strings.TrimFunc(string(sf.Key()[:]), decrapifySequenceKey)
-		fmt.Printf("%s\n", sfk)
+		sfk := ecn.SequenceKey(sf)
+		if !ks.match(sfk) {
+			continue
+		}
+
+		if sizes {
+			fmt.Printf("%s\t%d\n", sfk, len(ecn.SequenceValue(sf)))
+		} else {
+			fmt.Printf("%s\n", sfk)
+		}
 	}
 	return sf.Err()
 }
 
-func extract(sf *sequencefile.Reader, k string) error {
-	for sf.Scan() {
+// listIndexed lists the keys in the index next to the sequence file, without
+// reading the file itself.
+func listIndexed(si *ecn.SequenceIndex, ks *keySelector) {
+	for _, k := range si.Keys() {
+		if ks.match(k) {
+			fmt.Printf("%s\n", k)
+		}
+	}
+}
+
+// extractIndexed extracts a single entry using the index next to the
+// sequence file, reading only from the sync point preceding the entry.
+func extractIndexed(filename string, si *ecn.SequenceIndex, k string, out io.Writer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-		sfk := strings.TrimFunc(string(sf.Key()[:]), decrapifySequenceKey)
-		log.Printf("comparing %#v == %#v", k, sfk)
+	sf, err := si.Seek(f, k)
+	if err != nil {
+		return err
+	}
 
-		if k == sfk {
-			log.Printf("extracting %s", sfk)
+	return ecn.ExtractSequenceEntry(sf, k, out)
+}
 
-			out, err := os.Create(k)
-			if err != nil {
-				return err
-			}
-			_, err = out.Write(sf.Value())
-			return err
+// extractOne extracts a single entry, directly if there's an index next to
+// the sequence file, and by scanning the file otherwise.
+func extractOne(filename string, k string, out io.Writer) error {
+	si, err := ecn.ReadSequenceIndex(filename + ecn.SequenceIndexSuffix)
+	if err == nil {
+		return extractIndexed(filename, si, k, out)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	sf, err := sequencefile.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	return ecn.ExtractSequenceEntry(sf, k, out)
+}
+
+// extractToFile extracts a single entry into a file named after its key in
+// the output directory. Nothing is left behind if the entry is missing.
+func extractToFile(filename string, k string, outdir string) error {
+	outpath, err := safeOutputPath(outdir, k)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outpath), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(outpath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("extracting %s to %s", k, outpath)
+
+	err = extractOne(filename, k, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outpath)
+	}
+
+	return err
+}
+
+// buildIndex builds an index for a sequence file and writes it next to it.
+func buildIndex(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	si, err := ecn.BuildSequenceIndex(f)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("indexed %d keys in %s", len(si.Offsets), filename)
+
+	return si.WriteFile(filename + ecn.SequenceIndexSuffix)
+}
+
+func writeEntry(outpath string, value []byte) error {
+	if err := os.MkdirAll(filepath.Dir(outpath), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(outpath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := out.Write(value); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// campaignMetadata reads the campaign metadata to add to the metadata of each
+// extracted entry, from a file if given and from keys set on the command line.
+func campaignMetadata(metafile string, set metaKeys) (map[string]interface{}, error) {
+	keys := make(map[string]interface{})
+
+	if metafile != "" {
+		var err error
+		if keys, err = ecn.ReadMetadataFile(metafile); err != nil {
+			return nil, err
 		}
 	}
-	if err := sf.Err(); err != nil {
+
+	for k, v := range set {
+		keys[k] = v
+	}
+
+	return keys, nil
+}
+
+// writeEntryMetadata detects the filetype and time range of an extracted
+// entry, and writes them with the campaign metadata next to the entry. Keys
+// from the metadata entry stored with the entry in the archive, if any, take
+// precedence over detected ones, and campaign keys given explicitly over both.
+func writeEntryMetadata(outpath string, value []byte, archived []byte, campaign map[string]interface{}) error {
+	b, err := json.Marshal(campaign)
+	if err != nil {
+		return err
+	}
+
+	md, err := pto3.RawMetadataFromReader(bytes.NewReader(b), nil)
+	if err != nil {
+		return err
+	}
+
+	rs, err := ecn.SummarizeRaw(bytes.NewReader(value), "", md)
+	if err != nil {
 		return err
 	}
-	return fmt.Errorf("missing key %s; use -list to list keys", k)
+
+	// metadata files left in the output directory by earlier runs are not
+	// archived metadata, so only the entry read from the archive is merged
+	stored := make(map[string]interface{})
+	if archived != nil {
+		if err := json.Unmarshal(archived, &stored); err != nil {
+			return fmt.Errorf("cannot parse archived metadata: %s", err.Error())
+		}
+	}
+
+	keys := rs.Metadata()
+	for k, v := range stored {
+		keys[k] = v
+	}
+	for k, v := range campaign {
+		keys[k] = v
+	}
+
+	return ecn.WriteMetadataFile(outpath+ecn.EntryMetadataSuffix, keys)
 }
 
-func extractAll(sf *sequencefile.Reader) error {
+func extractAll(sf *sequencefile.Reader, ks *keySelector, outdir string, campaign map[string]interface{}) error {
+	// metadata entries precede their entries in the archive; keep them until
+	// we get to the entry, whether they are selected or not
+	archived := make(map[string][]byte)
+
 	for sf.Scan() {
+		sfk := ecn.SequenceKey(sf)
+		if campaign != nil && strings.HasSuffix(sfk, ecn.EntryMetadataSuffix) {
+			archived[strings.TrimSuffix(sfk, ecn.EntryMetadataSuffix)] = append([]byte(nil), ecn.SequenceValue(sf)...)
+		}
 
-		sfk := strings.TrimFunc(string(sf.Key()[:]), decrapifySequenceKey)
+		if !ks.match(sfk) {
+			continue
+		}
 
-		if err := sf.Err(); err != nil {
+		outpath, err := safeOutputPath(outdir, sfk)
+		if err != nil {
 			return err
 		}
 
-		log.Printf("extracting %s", sfk)
+		log.Printf("extracting %s to %s", sfk, outpath)
 
-		out, err := os.Create(sfk)
-		if err != nil {
+		value := ecn.SequenceValue(sf)
+		if err := writeEntry(outpath, value); err != nil {
 			return err
 		}
 
-		if _, err := out.Write(sf.Value()); err != nil {
-			return err
+		// entries we can't make sense of are still extracted, and metadata
+		// entries are metadata already
+		if campaign != nil && !strings.HasSuffix(sfk, ecn.EntryMetadataSuffix) {
+			if err := writeEntryMetadata(outpath, value, archived[sfk], campaign); err != nil {
+				log.Printf("cannot write metadata for %s: %s", sfk, err.Error())
+			}
+			delete(archived, sfk)
 		}
 	}
 
-	return nil
+	return sf.Err()
 }
 
 func main() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s: list or extract entries from a sequence file\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Usage: %s [-list|-extract key] file.seq\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [-index|-list [-sizes]|-extract key|-cat key] [-glob pattern] [-regex re] [-o dir] [-mkmeta [-metadata file] [-set key=value]...] file.seq\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 	args := flag.Args()
 
+	if *helpFlag {
+		flag.Usage()
+		os.Exit(0)
+	}
+
 	if len(args) != 1 {
 		fmt.Fprintln(os.Stderr, "must supply exactly one sequence file")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	sf, err := sequencefile.Open(args[0])
+	ks, err := newKeySelector(*globFlag, *regexFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if *listFlag {
-		if err := list(sf); err != nil {
+	// metadata is only written when extracting all selected entries
+	if *mkmetaFlag && (*indexFlag || *listFlag || *extractFlag != "" || *catFlag != "") {
+		log.Fatal("-mkmeta cannot be used with -index, -list, -extract or -cat")
+	}
+
+	if *indexFlag {
+		if err := buildIndex(args[0]); err != nil {
 			log.Fatal(err)
 		}
-	} else if *extractFlag != "" {
-		if err := extract(sf, *extractFlag); err != nil {
+		return
+	}
+
+	if *extractFlag != "" {
+		if err := extractToFile(args[0], *extractFlag, *outdirFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *catFlag != "" {
+		if err := extractOne(args[0], *catFlag, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// list directly if there's an index; sizes are not indexed
+	if *listFlag && !*sizesFlag {
+		si, err := ecn.ReadSequenceIndex(args[0] + ecn.SequenceIndexSuffix)
+		if err == nil {
+			listIndexed(si, ks)
+			return
+		} else if !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+
+	sf, err := sequencefile.Open(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *listFlag {
+		if err := list(sf, ks, *sizesFlag); err != nil {
 			log.Fatal(err)
 		}
 	} else {
-		log.Printf("extracting everything from %s", args[0])
-		if err := extractAll(sf); err != nil {
+		var campaign map[string]interface{}
+		if *mkmetaFlag {
+			if campaign, err = campaignMetadata(*metafileFlag, setKeys); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		log.Printf("extracting entries from %s to %s", args[0], *outdirFlag)
+		if err := extractAll(sf, ks, *outdirFlag, campaign); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ecn "github.com/mami-project/pto3-ecn"
+)
+
+func TestWriteEntryMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "desequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	value := []byte(`{"sip": "192.0.2.1", "dip": "198.51.100.1", "dp": 80, "time": {"from": "2018-03-01 00:00:00", "to": "2018-03-01 00:00:01"}, "conditions": ["ecn.connectivity.works"]}` + "\n")
+
+	tests := []struct {
+		archived string // empty if the archive has no metadata entry
+		campaign map[string]interface{}
+		vantage  string
+	}{
+		{"", map[string]interface{}{}, "192.0.2.1"},
+		{`{"vantage": "archived"}`, map[string]interface{}{}, "archived"},
+		{`{"vantage": "archived"}`, map[string]interface{}{"vantage": "campaign"}, "campaign"},
+	}
+
+	for i, test := range tests {
+		outpath := filepath.Join(dir, "entry.ndjson")
+		metafilename := outpath + ecn.EntryMetadataSuffix
+
+		// metadata left behind by an earlier run must not be merged
+		if err := ioutil.WriteFile(metafilename, []byte(`{"vantage": "stale", "stale": "yes"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var archived []byte
+		if test.archived != "" {
+			archived = []byte(test.archived)
+		}
+
+		if err := writeEntryMetadata(outpath, value, archived, test.campaign); err != nil {
+			t.Fatalf("%d: %s", i, err.Error())
+		}
+
+		keys, err := ecn.ReadMetadataFile(metafilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := keys["stale"]; ok {
+			t.Errorf("%d: stale metadata merged: %v", i, keys)
+		}
+		if keys["vantage"] != test.vantage {
+			t.Errorf("%d: vantage %v, want %s", i, keys["vantage"], test.vantage)
+		}
+		if keys["_file_type"] != ecn.FiletypePathspiderV1 {
+			t.Errorf("%d: filetype %v, want %s", i, keys["_file_type"], ecn.FiletypePathspiderV1)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -15,21 +16,53 @@ import (
 	pto3 "github.com/mami-project/pto3-go"
 )
 
+// conditions generated by the path dependency analyzer
+const (
+	condConnMPWorks     = "ecn.multipoint.connectivity.works"
+	condConnMPBroken    = "ecn.multipoint.connectivity.broken"
+	condConnMPOffline   = "ecn.multipoint.connectivity.offline"
+	condConnMPTransient = "ecn.multipoint.connectivity.transient"
+	condConnMPPathDep   = "ecn.multipoint.connectivity.path_dependent"
+	condConnMPUnstable  = "ecn.multipoint.connectivity.unstable"
+
+	condNegoMPWorks     = "ecn.multipoint.negotiation.succeeded"
+	condNegoMPFailed    = "ecn.multipoint.negotiation.failed"
+	condNegoMPReflected = "ecn.multipoint.negotiation.reflected"
+	condNegoMPPathDep   = "ecn.multipoint.negotiation.path_dependent"
+	condNegoMPUnstable  = "ecn.multipoint.negotiation.unstable"
+)
+
+// multipointConditions lists the conditions generated by the path
+// dependency analyzer, for the descriptor
+var multipointConditions = []string{
+	condConnMPWorks,
+	condConnMPBroken,
+	condConnMPOffline,
+	condConnMPTransient,
+	condConnMPPathDep,
+	condConnMPUnstable,
+	condNegoMPWorks,
+	condNegoMPFailed,
+	condNegoMPReflected,
+	condNegoMPPathDep,
+	condNegoMPUnstable,
+}
+
 func pathdepECN(in io.Reader, out io.Writer) error {
 
 	// create some conditions
-	connMPWorks := pto3.NewCondition("ecn.multipoint.connectivity.works")
-	connMPBroken := pto3.NewCondition("ecn.multipoint.connectivity.broken")
-	connMPOffline := pto3.NewCondition("ecn.multipoint.connectivity.offline")
-	connMPTransient := pto3.NewCondition("ecn.multipoint.connectivity.transient")
-	connMPPathDep := pto3.NewCondition("ecn.multipoint.connectivity.path_dependent")
-	connMPUnstable := pto3.NewCondition("ecn.multipoint.connectivity.unstable")
-
-	negoMPWorks := pto3.NewCondition("ecn.multipoint.negotiation.succeeded")
-	negoMPFailed := pto3.NewCondition("ecn.multipoint.negotiation.failed")
-	negoMPReflected := pto3.NewCondition("ecn.multipoint.negotiation.reflected")
-	negoMPPathDep := pto3.NewCondition("ecn.multipoint.negotiation.path_dependent")
-	negoMPUnstable := pto3.NewCondition("ecn.multipoint.negotiation.unstable")
+	connMPWorks := pto3.NewCondition(condConnMPWorks)
+	connMPBroken := pto3.NewCondition(condConnMPBroken)
+	connMPOffline := pto3.NewCondition(condConnMPOffline)
+	connMPTransient := pto3.NewCondition(condConnMPTransient)
+	connMPPathDep := pto3.NewCondition(condConnMPPathDep)
+	connMPUnstable := pto3.NewCondition(condConnMPUnstable)
+
+	negoMPWorks := pto3.NewCondition(condNegoMPWorks)
+	negoMPFailed := pto3.NewCondition(condNegoMPFailed)
+	negoMPReflected := pto3.NewCondition(condNegoMPReflected)
+	negoMPPathDep := pto3.NewCondition(condNegoMPPathDep)
+	negoMPUnstable := pto3.NewCondition(condNegoMPUnstable)
 
 	// map targets to sources to condition counts
 	mvTable := make(map[string]map[string]*ecn.CondCount)
@@ -171,7 +204,34 @@ func pathdepECN(in io.Reader, out io.Writer) error {
 	return nil
 }
 
+// descriptor describes this analyzer to the PTO
+func descriptor() *ecn.Descriptor {
+	return &ecn.Descriptor{
+		Owner:       ecn.DescriptorOwner,
+		Description: "An analyzer to combine ECN observations from multiple vantage points to find evidence of path dependency",
+		Conditions:  multipointConditions,
+		Platform:    ecn.DescriptorPlatform,
+		Invocation:  "ecn_pathdep",
+	}
+}
+
+var descriptorFlags = ecn.NewDescriptorFlags()
+
 func main() {
+	flag.Parse()
+
+	// describe this analyzer instead of running if requested
+	if descriptorFlags.Requested() {
+		ok, err := descriptorFlags.Run(descriptor(), os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// just wrap stdin and stdout and go
 	if err := pathdepECN(os.Stdin, os.Stdout); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,376 @@
+// ecn_pcap_normalizer is a local normalizer (for use with ptonorm) that
+// reconstructs TCP flows from pcap or pcapng packet captures taken during ECN
+// measurements, pairs ECN-setup and plain handshakes to the same targets, and
+// converts them to PTO observations.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	ecn "github.com/mami-project/pto3-ecn"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// hardcode analyzer path (FIXME, tag?)
+const metadataURL = "https://raw.githubusercontent.com/mami-project/pto3-ecn/master/ecn_pcap_normalizer/ecn_pcap_normalizer.json"
+
+const synAck = ecn.SYN | ecn.ACK
+
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// packetReader is implemented by both the pcap and the pcapng readers
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// newPacketReader creates a packet reader for a pcap or pcapng stream,
+// detecting which from the magic number at the start of the stream.
+func newPacketReader(in io.Reader) (packetReader, error) {
+	br := bufio.NewReader(in)
+
+	magic, err := br.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read capture header: %s", err.Error())
+	}
+
+	if bytes.Equal(magic, pcapngMagic) {
+		return pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	}
+
+	return pcapgo.NewReader(br)
+}
+
+// pcapFlow accumulates the packets of a single TCP connection, in the
+// direction of the initial SYN.
+type pcapFlow struct {
+	startTime       time.Time
+	srcAddr         net.IP
+	dstAddr         net.IP
+	srcPort         uint16
+	dstPort         uint16
+	initialFlags    uint8
+	lastSynFlags    uint8
+	revLastSynFlags uint8
+	revQofChars     uint32
+	packets         uint64
+	fwdFin          bool
+	revFin          bool
+	reset           bool
+}
+
+func (flow *pcapFlow) complete() bool {
+	return flow.reset || (flow.fwdFin && flow.revFin)
+}
+
+// fields converts the flow to a map keyed by the IPFIX information element
+// names QoF would have exported for it.
+func (flow *pcapFlow) fields() map[string]interface{} {
+	out := make(map[string]interface{})
+
+	out["flowStartMilliseconds"] = flow.startTime
+	out["sourceTransportPort"] = flow.srcPort
+	out["destinationTransportPort"] = flow.dstPort
+	out["initialTCPFlags"] = flow.initialFlags
+	out["lastSynTcpFlags"] = flow.lastSynFlags
+	out["reverseLastSynTcpFlags"] = flow.revLastSynFlags
+	out["reverseQofTcpCharacteristics"] = flow.revQofChars
+	out["packetDeltaCount"] = flow.packets
+
+	if flow.srcAddr.To4() != nil {
+		out["sourceIPv4Address"] = &flow.srcAddr
+		out["destinationIPv4Address"] = &flow.dstAddr
+	} else {
+		out["sourceIPv6Address"] = &flow.srcAddr
+		out["destinationIPv6Address"] = &flow.dstAddr
+	}
+
+	return out
+}
+
+func flowKey(srcAddr net.IP, srcPort uint16, dstAddr net.IP, dstPort uint16) string {
+	return fmt.Sprintf("%s %d %s %d", srcAddr.String(), srcPort, dstAddr.String(), dstPort)
+}
+
+func tcpFlags(tcp *layers.TCP) uint8 {
+	var flags uint8
+	for _, f := range []struct {
+		set  bool
+		flag uint8
+	}{
+		{tcp.FIN, ecn.FIN}, {tcp.SYN, ecn.SYN}, {tcp.RST, ecn.RST}, {tcp.PSH, ecn.PSH},
+		{tcp.ACK, ecn.ACK}, {tcp.URG, ecn.URG}, {tcp.ECE, ecn.ECE}, {tcp.CWR, ecn.CWR},
+	} {
+		if f.set {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// ipMarkChars maps the ECN field of an IP header to QoF characteristics bits
+func ipMarkChars(tos uint8) uint32 {
+	switch tos & 0x03 {
+	case 0x02:
+		return ecn.QECT0
+	case 0x01:
+		return ecn.QECT1
+	case 0x03:
+		return ecn.QCE
+	default:
+		return 0
+	}
+}
+
+// pcapFlowTable reconstructs flows from packets, and passes completed flows
+// to a QoF observer.
+type pcapFlowTable struct {
+	qobs  *ecn.QofObserver
+	flows map[string]*pcapFlow
+}
+
+func (ft *pcapFlowTable) emit(key string, flow *pcapFlow) error {
+	delete(ft.flows, key)
+
+	if err := ft.qobs.HandleFlow(flow.fields()); err != nil {
+		return err
+	}
+	if ft.qobs.HandledFlowCount()%1000 == 0 {
+		ft.qobs.LogStatus()
+	}
+
+	return nil
+}
+
+func (ft *pcapFlowTable) handlePacket(packet gopacket.Packet, timestamp time.Time) error {
+
+	// extract addresses and the ECN field from the IP header
+	var srcAddr, dstAddr net.IP
+	var tos uint8
+
+	if ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		srcAddr, dstAddr, tos = ip4.SrcIP, ip4.DstIP, ip4.TOS
+	} else if ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		srcAddr, dstAddr, tos = ip6.SrcIP, ip6.DstIP, ip6.TrafficClass
+	} else {
+		return nil
+	}
+
+	// skip everything that isn't TCP
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil
+	}
+
+	srcPort, dstPort := uint16(tcp.SrcPort), uint16(tcp.DstPort)
+	flags := tcpFlags(tcp)
+
+	fwdKey := flowKey(srcAddr, srcPort, dstAddr, dstPort)
+	revKey := flowKey(dstAddr, dstPort, srcAddr, srcPort)
+
+	if flow, ok := ft.flows[fwdKey]; ok {
+		// packet in the direction of the initial SYN
+		flow.packets++
+		if flags&synAck == ecn.SYN {
+			flow.lastSynFlags = flags
+		}
+		flow.fwdFin = flow.fwdFin || flags&ecn.FIN != 0
+		flow.reset = flow.reset || flags&ecn.RST != 0
+
+		if flow.complete() {
+			return ft.emit(fwdKey, flow)
+		}
+	} else if flow, ok := ft.flows[revKey]; ok {
+		// packet in the reverse direction: note SYN-ACK flags,
+		// and IP ECN marks on everything else
+		if flags&synAck == synAck {
+			flow.revLastSynFlags = flags
+		} else {
+			flow.revQofChars |= ipMarkChars(tos)
+		}
+		flow.revFin = flow.revFin || flags&ecn.FIN != 0
+		flow.reset = flow.reset || flags&ecn.RST != 0
+
+		if flow.complete() {
+			return ft.emit(revKey, flow)
+		}
+	} else if flags&synAck == ecn.SYN {
+		// new flow on initial SYN
+		ft.flows[fwdKey] = &pcapFlow{
+			startTime:    timestamp.UTC(),
+			srcAddr:      srcAddr,
+			dstAddr:      dstAddr,
+			srcPort:      srcPort,
+			dstPort:      dstPort,
+			initialFlags: flags,
+			lastSynFlags: flags,
+			packets:      1,
+		}
+	}
+
+	return nil
+}
+
+// flush passes all flows still in the table to the observer, in start order.
+func (ft *pcapFlowTable) flush() error {
+	keys := make([]string, 0, len(ft.flows))
+	for k := range ft.flows {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return ft.flows[keys[i]].startTime.Before(ft.flows[keys[j]].startTime)
+	})
+
+	for _, k := range keys {
+		if err := ft.emit(k, ft.flows[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func normalizePcap(in io.Reader, metain io.Reader, out io.Writer) error {
+	// unmarshal metadata into an RDS metadata object
+	md, err := pto3.RawMetadataFromReader(metain, nil)
+	if err != nil {
+		return fmt.Errorf("could not read metadata: %s", err.Error())
+	}
+
+	// check filetype and decompress if necessary
+	r, filetype, err := ecn.OpenInput(in, md.Filetype(true))
+	if err != nil {
+		return err
+	}
+
+	switch filetype {
+	case "ecn-pcap", "ecn-pcapng":
+	default:
+		return fmt.Errorf("unsupported filetype %s", md.Filetype(true))
+	}
+
+	// create a packet reader; pcap or pcapng is detected from the content
+	pr, err := newPacketReader(r)
+	if err != nil {
+		return err
+	}
+
+	// create an extractor around the output stream and initialize it with metadata
+	qobs, err := ecn.NewQofObserver(out, md)
+	if err != nil {
+		return err
+	}
+
+	ft := pcapFlowTable{qobs: qobs, flows: make(map[string]*pcapFlow)}
+
+	// now iterate over packets
+	for {
+		data, ci, err := pr.ReadPacketData()
+		if err != nil {
+			if err == io.EOF {
+				break
+			} else {
+				return err
+			}
+		}
+
+		packet := gopacket.NewPacket(data, pr.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		if err := ft.handlePacket(packet, ci.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	// flows without FIN or RST are only complete at the end of the capture
+	if err := ft.flush(); err != nil {
+		return err
+	}
+
+	qobs.LogStatus()
+
+	// now write metadata
+	return qobs.WriteMetadata(md, metadataURL)
+}
+
+var validateFlag = flag.Bool("validate", false, "check metadata against raw data and report mismatches as JSON instead of normalizing")
+
+var normalizerFlags = ecn.NewNormalizerFlags()
+
+// descriptor describes this normalizer to the PTO
+func descriptor() *ecn.Descriptor {
+	return &ecn.Descriptor{
+		Owner:       ecn.DescriptorOwner,
+		Description: "A normalizer to extract ECN observations from pcap and pcapng packet captures of ECN-setup and plain TCP handshakes",
+		FileTypes:   ecn.CompressedFiletypes(ecn.FiletypePcap, ecn.FiletypePcapng),
+		Conditions:  ecn.QofPairConditions(),
+		Platform:    ecn.DescriptorPlatform,
+		Invocation:  "ecn_pcap_normalizer",
+	}
+}
+
+var descriptorFlags = ecn.NewDescriptorFlags()
+
+// run normalizes and returns the exit status; main exits with it once the
+// output file given with -out has been closed.
+func run() int {
+	// describe this normalizer instead of running if requested
+	if descriptorFlags.Requested() {
+		ok, err := descriptorFlags.Run(descriptor(), os.Stdout)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if !ok {
+			return 1
+		}
+		return 0
+	}
+
+	// open input, metadata and output streams
+	nio, err := normalizerFlags.Open()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer nio.Close()
+
+	// check metadata against content instead of normalizing if requested
+	if *validateFlag {
+		valid, err := ecn.ValidateInput(nio.In, nio.Meta, nio.Out, []string{ecn.FiletypePcap, ecn.FiletypePcapng})
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if !valid {
+			return 1
+		}
+		return 0
+	}
+
+	// and go
+	if err := ecn.NormalizeInput(nio.In, nio.Meta, nio.Out, normalizePcap); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	return 0
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
+}
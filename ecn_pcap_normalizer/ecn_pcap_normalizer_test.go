@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	ecn "github.com/mami-project/pto3-ecn"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// testPacket is a single IPv4 TCP packet in a capture fixture
+type testPacket struct {
+	src, dst     string
+	sport, dport uint16
+	flags        uint8
+	tos          uint8
+}
+
+// encode builds a raw IPv4 header and TCP header for the packet; checksums
+// are left zero, as the normalizer never checks them.
+func (p testPacket) encode() []byte {
+	b := make([]byte, 40)
+
+	b[0] = 0x45
+	b[1] = p.tos
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[8] = 64
+	b[9] = 6
+	copy(b[12:16], net.ParseIP(p.src).To4())
+	copy(b[16:20], net.ParseIP(p.dst).To4())
+
+	binary.BigEndian.PutUint16(b[20:], p.sport)
+	binary.BigEndian.PutUint16(b[22:], p.dport)
+	b[32] = 0x50
+	b[33] = p.flags // TCP header flag bits are laid out as the ecn flag constants
+	binary.BigEndian.PutUint16(b[34:], 65535)
+
+	return b
+}
+
+// fwd and rev build packets from and to the client port of a flow
+func fwd(sport uint16, flags uint8, tos uint8) testPacket {
+	return testPacket{"10.0.0.1", "192.0.2.1", sport, 80, flags, tos}
+}
+
+func rev(sport uint16, flags uint8, tos uint8) testPacket {
+	return testPacket{"192.0.2.1", "10.0.0.1", 80, sport, flags, tos}
+}
+
+const (
+	ecnSyn = ecn.SYN | ecn.ECE | ecn.CWR
+	finAck = ecn.FIN | ecn.ACK
+	ect0   = 0x02
+	ect1   = 0x01
+	ce     = 0x03
+)
+
+// pcapFixture exercises completion by FIN in both directions and by RST,
+// reverse IP ECN marks, a packet from a flow whose SYN was not captured, and
+// flows still open at the end of the capture, which start in the reverse of
+// the order their ports sort in.
+var pcapFixture = []testPacket{
+	fwd(40000, ecnSyn, 0),
+	fwd(40001, ecn.SYN, 0),
+	rev(40000, synAck|ecn.ECE, 0),
+	rev(40001, synAck, 0),
+	rev(40001, ecn.ACK, ect1),
+	rev(40001, ecn.RST|ecn.ACK, 0),
+	fwd(40000, ecn.ACK, ect0),
+	rev(40000, ecn.ACK, ect0),
+	fwd(40000, finAck, ect0),
+	rev(40000, finAck, ect0),
+	fwd(40099, ecn.ACK, 0),
+	fwd(40003, ecn.SYN, 0),
+	fwd(40002, ecnSyn, 0),
+	rev(40002, synAck|ecn.ECE, 0),
+	rev(40002, ecn.ACK, ce),
+	fwd(40003, ecn.SYN, 0),
+}
+
+type tracedFlow struct {
+	Fields struct {
+		SourceTransportPort          uint16 `json:"sourceTransportPort"`
+		InitialTCPFlags              uint8  `json:"initialTCPFlags"`
+		LastSynTcpFlags              uint8  `json:"lastSynTcpFlags"`
+		ReverseLastSynTcpFlags       uint8  `json:"reverseLastSynTcpFlags"`
+		ReverseQofTcpCharacteristics uint32 `json:"reverseQofTcpCharacteristics"`
+		PacketDeltaCount             uint64 `json:"packetDeltaCount"`
+	} `json:"fields"`
+}
+
+func tracedFlows(t *testing.T, trace *bytes.Buffer) []tracedFlow {
+	t.Helper()
+
+	var out []tracedFlow
+	scanner := bufio.NewScanner(trace)
+	for scanner.Scan() {
+		var tf tracedFlow
+		if err := json.Unmarshal(scanner.Bytes(), &tf); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, tf)
+	}
+	trace.Reset()
+
+	return out
+}
+
+func TestPcapFlowTable(t *testing.T) {
+	md, err := pto3.RawMetadataFromReader(strings.NewReader(`{}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out, trace bytes.Buffer
+	qobs, err := ecn.NewQofObserver(&out, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qobs.SetTrace(&trace)
+
+	ft := pcapFlowTable{qobs: qobs, flows: make(map[string]*pcapFlow)}
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, p := range pcapFixture {
+		packet := gopacket.NewPacket(p.encode(), layers.LinkTypeRaw, gopacket.Default)
+		if err := ft.handlePacket(packet, start.Add(time.Duration(i)*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		stage       string
+		port        uint16
+		initial     uint8
+		lastSyn     uint8
+		revLastSyn  uint8
+		revQofChars uint32
+		packets     uint64
+	}{
+		{"completed", 40001, ecn.SYN, ecn.SYN, synAck, ecn.QECT1, 1},
+		{"completed", 40000, ecnSyn, ecnSyn, synAck | ecn.ECE, ecn.QECT0, 3},
+		{"flushed", 40003, ecn.SYN, ecn.SYN, 0, 0, 2},
+		{"flushed", 40002, ecnSyn, ecnSyn, synAck | ecn.ECE, ecn.QCE, 1},
+	}
+
+	flows := tracedFlows(t, &trace)
+	if len(flows) != 2 || len(ft.flows) != 2 {
+		t.Fatalf("%d flows completed and %d open before flush, want 2 and 2", len(flows), len(ft.flows))
+	}
+
+	if err := ft.flush(); err != nil {
+		t.Fatal(err)
+	}
+	flows = append(flows, tracedFlows(t, &trace)...)
+	if len(flows) != len(tests) || len(ft.flows) != 0 {
+		t.Fatalf("%d flows emitted and %d left after flush, want %d and 0", len(flows), len(ft.flows), len(tests))
+	}
+
+	for i, test := range tests {
+		f := flows[i].Fields
+		if f.SourceTransportPort != test.port {
+			t.Errorf("%s flow %d from port %d, want %d", test.stage, i, f.SourceTransportPort, test.port)
+			continue
+		}
+		if f.InitialTCPFlags != test.initial || f.LastSynTcpFlags != test.lastSyn || f.ReverseLastSynTcpFlags != test.revLastSyn {
+			t.Errorf("%s flow %d: SYN flags %#x/%#x/%#x, want %#x/%#x/%#x", test.stage, test.port,
+				f.InitialTCPFlags, f.LastSynTcpFlags, f.ReverseLastSynTcpFlags,
+				test.initial, test.lastSyn, test.revLastSyn)
+		}
+		if f.ReverseQofTcpCharacteristics != test.revQofChars {
+			t.Errorf("%s flow %d: reverse characteristics %#x, want %#x", test.stage, test.port,
+				f.ReverseQofTcpCharacteristics, test.revQofChars)
+		}
+		if f.PacketDeltaCount != test.packets {
+			t.Errorf("%s flow %d: %d packets, want %d", test.stage, test.port, f.PacketDeltaCount, test.packets)
+		}
+	}
+}
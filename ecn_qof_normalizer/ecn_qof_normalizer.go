@@ -3,24 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/bzip2"
-	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
 	"regexp"
 	"strconv"
-	"strings"
-	"time"
 
 	"github.com/calmh/ipfix"
 
+	ecn "github.com/mami-project/pto3-ecn"
 	pto3 "github.com/mami-project/pto3-go"
 )
 
+// hardcode analyzer path (FIXME, tag?)
+const metadataURL = "https://raw.githubusercontent.com/mami-project/pto3-ecn/master/ecn_qof_normalizer/ecn_qof_normalizer.json"
+
 func init() {
 	var err error
 	ieSpecRegexp, err = regexp.Compile(`^([^\s\[\<\(]+)?(\(((\d+)\/)?(\d+)\))?(\<(\S+)\>)?(\[(\S+)\])?`)
@@ -40,6 +39,12 @@ func init() {
 		"sourceIPv6Address":            struct{}{},
 		"destinationIPv4Address":       struct{}{},
 		"destinationIPv6Address":       struct{}{},
+		"packetDeltaCount":             struct{}{},
+		"minTcpRttMilliseconds":        struct{}{},
+		"declaredTcpMss":               struct{}{},
+		"observedTcpMss":               struct{}{},
+		"tcpRetransmitCount":           struct{}{},
+		"tcpLossEventCount":            struct{}{},
 	}
 
 }
@@ -157,336 +162,29 @@ func qofSession() (*ipfix.Session, *ipfix.Interpreter) {
 	return s, i
 }
 
-type QofObserver struct {
-	out             io.Writer
-	sourceOverride  string
-	sourcePrepend   string
-	requiredDstPort uint16
-
-	hasCondition map[string]struct{}
-
-	pendingTCPFlows map[string]*QofTCPFlow
-	pendingECNFlows map[string]*QofTCPFlow
-
-	sourceCounts          map[string]int
-	sourceRejectThreshold int
-
-	handledFlowCount int
-	ignoredFlowCount int
-}
-
-func NewQofObserver() *QofObserver {
-	out := new(QofObserver)
-
-	out.hasCondition = make(map[string]struct{})
-	out.pendingTCPFlows = make(map[string]*QofTCPFlow)
-	out.pendingECNFlows = make(map[string]*QofTCPFlow)
-	out.sourceCounts = make(map[string]int)
-	out.sourceRejectThreshold = 100
-	return out
-}
-
-const (
-	FIN      = 0x01
-	SYN      = 0x02
-	RST      = 0x04
-	PSH      = 0x08
-	ACK      = 0x10
-	URG      = 0x20
-	ECE      = 0x40
-	CWR      = 0x80
-	QECT0    = 0x01
-	QECT1    = 0x02
-	QCE      = 0x04
-	QTSOPT   = 0x10
-	QSACKOPT = 0x20
-	QWSOPT   = 0x40
-	QSYNECT0 = 0x0100
-	QSYNECT1 = 0x0200
-	QSYNCE   = 0x0400
-)
-
-type QofTCPFlow struct {
-	startTime     time.Time
-	srcAddr       *net.IP
-	dstAddr       *net.IP
-	srcPort       uint16
-	dstPort       uint16
-	fwdLastSyn    uint8
-	revLastSyn    uint8
-	revQofChars   uint32
-	didEstablish  bool
-	ecnAttempted  bool
-	ecnNegotiated bool
-	ecnReflected  bool
-	ecnECT0       bool
-	ecnECT1       bool
-	ecnCE         bool
-}
-
-func flowFromMap(fmap map[string]interface{}, requireSyn bool, requireDport uint16) (*QofTCPFlow, error) {
-
-	// drop flows without syn
-	if requireSyn {
-		fif, ok := fmap["initialTCPFlags"]
-		if !ok {
-			return nil, fmt.Errorf("missing initial flags")
-		}
-
-		if fif.(uint8)&SYN == 0 {
-			return nil, fmt.Errorf("no syn")
-		}
-	}
-
-	// drop flows without required port
-	dp, ok := fmap["destinationTransportPort"]
-	if !ok {
-		return nil, fmt.Errorf("missing destination port")
-	}
-
-	if requireDport > 0 && dp.(uint16) != requireDport {
-		return nil, fmt.Errorf("bad destination port")
-	}
-
-	// get the rest of the required keys from the map
-	stime, ok := fmap["flowStartMilliseconds"]
-	if !ok {
-		return nil, fmt.Errorf("missing start time")
-	}
-
-	sa, ok := fmap["sourceIPv4Address"]
-	if !ok {
-		sa, ok = fmap["sourceIPv6Address"]
-		if !ok {
-			return nil, fmt.Errorf("missing source IP address")
-		}
-	}
-
-	da, ok := fmap["destinationIPv4Address"]
-	if !ok {
-		da, ok = fmap["destinationIPv6Address"]
-		if !ok {
-			return nil, fmt.Errorf("missing destination IP address")
-		}
-	}
-
-	sp, ok := fmap["sourceTransportPort"]
-	if !ok {
-		return nil, fmt.Errorf("missing source port")
-	}
-
-	fls, ok := fmap["lastSynTcpFlags"]
-	if !ok {
-		return nil, fmt.Errorf("missing forward syn flags")
-	}
-
-	rls, ok := fmap["reverseLastSynTcpFlags"]
-	if !ok {
-		return nil, fmt.Errorf("missing reverse syn flags")
-	}
-
-	rqc, ok := fmap["reverseQofTcpCharacteristics"]
-	if !ok {
-		return nil, fmt.Errorf("missing magic qof stuff")
-	}
-
-	// make a new flow
-	out := new(QofTCPFlow)
-
-	// extract time, addresses and ports
-	out.startTime = stime.(time.Time)
-	out.srcAddr = sa.(*net.IP)
-	out.dstAddr = da.(*net.IP)
-	out.srcPort = sp.(uint16)
-	out.dstPort = dp.(uint16)
-
-	// extract TCP flags
-	out.fwdLastSyn = fls.(uint8)
-	out.revLastSyn = rls.(uint8)
-	out.revQofChars = rqc.(uint32)
-
-	// calculate characteristics
-	out.ecnAttempted = out.fwdLastSyn&(SYN|ACK|ECE|CWR) == (SYN | ECE | CWR)
-	out.ecnNegotiated = out.revLastSyn&(SYN|ACK|ECE|CWR) == (SYN | ACK | ECE)
-	out.ecnReflected = out.revLastSyn&(SYN|ACK|ECE|CWR) == (SYN | ACK | ECE | CWR)
-	out.ecnECT0 = out.revQofChars&QECT0 == QECT0
-	out.ecnECT1 = out.revQofChars&QECT0 == QECT1
-	out.ecnCE = out.revQofChars&QCE == QCE
-	out.didEstablish = (out.fwdLastSyn&(SYN|ACK|FIN|RST) == (SYN) &&
-		out.revLastSyn&(SYN|ACK|FIN|RST) == (SYN|ACK))
-
-	return out, nil
-}
-
-func (qobs *QofObserver) observe(pathflow *QofTCPFlow, conditions ...string) error {
-
-	// make a path
-	path := new(pto3.Path)
-
-	// handle source override from metadata
-	var source string
-	if qobs.sourceOverride != "" {
-		source = qobs.sourceOverride
-	} else {
-		source = pathflow.srcAddr.String()
-	}
-
-	// handle source prepend from metadata
-	var pathElements []string
-	if qobs.sourcePrepend != "" {
-		if source != "" {
-			pathElements = []string{qobs.sourcePrepend, source, "*", pathflow.dstAddr.String()}
-		} else {
-			pathElements = []string{qobs.sourcePrepend, "*", pathflow.dstAddr.String()}
-		}
-	} else {
-		if source != "" {
-			pathElements = []string{source, "*", pathflow.dstAddr.String()}
-		} else {
-			pathElements = []string{"*", pathflow.dstAddr.String()}
-		}
-	}
-
-	path.String = strings.Join(pathElements, " ")
-
-	obsen := make([]pto3.Observation, len(conditions))
-	for i, c := range conditions {
-		obsen[i].TimeStart = &pathflow.startTime
-		obsen[i].TimeEnd = &pathflow.startTime
-		obsen[i].Path = path
-		obsen[i].Condition = new(pto3.Condition)
-		obsen[i].Condition.Name = c
-
-		qobs.hasCondition[c] = struct{}{}
-	}
-
-	return pto3.WriteObservations(obsen, qobs.out)
-}
-
-func (qobs *QofObserver) matchFlows(flowkey string, tcpflow, ecnflow *QofTCPFlow) error {
-
-	// generate connectivity condition
-	var connectivityCondition string
-	if tcpflow.didEstablish && ecnflow.didEstablish {
-		connectivityCondition = "ecn.connectivity.works"
-	} else if tcpflow.didEstablish && !ecnflow.didEstablish {
-		connectivityCondition = "ecn.connectivity.broken"
-	} else if !tcpflow.didEstablish && ecnflow.didEstablish {
-		connectivityCondition = "ecn.connectivity.transient"
-	} else if !tcpflow.didEstablish && !ecnflow.didEstablish {
-		connectivityCondition = "ecn.connectivity.offline"
-	}
-
-	// generate negotiation condition
-	var negotiationCondition string
-	if ecnflow.ecnNegotiated {
-		negotiationCondition = "ecn.negotiation.succeeded"
-	} else if ecnflow.ecnReflected {
-		negotiationCondition = "ecn.negotiation.reflected"
-	} else {
-		negotiationCondition = "ecn.negotiation.failed"
-	}
-
-	// generate mark conditions
-	var ect0Condition, ect1Condition, ceCondition string
-	if ecnflow.ecnECT0 {
-		ect0Condition = "ecn.ipmark.ect0.seen"
-	} else {
-		ect0Condition = "ecn.ipmark.ect0.not_seen"
-	}
-
-	if ecnflow.ecnECT1 {
-		ect1Condition = "ecn.ipmark.ect1.seen"
-	} else {
-		ect1Condition = "ecn.ipmark.ect1.not_seen"
-	}
-
-	if ecnflow.ecnCE {
-		ceCondition = "ecn.ipmark.ce.seen"
-	} else {
-		ceCondition = "ecn.ipmark.ce.not_seen"
-	}
-
-	if err := qobs.observe(ecnflow, connectivityCondition, negotiationCondition, ect0Condition, ect1Condition, ceCondition); err != nil {
-		return err
-	}
-
-	// match is no longer pending
-	delete(qobs.pendingECNFlows, flowkey)
-	delete(qobs.pendingTCPFlows, flowkey)
-
-	return nil
-}
-
-func (qobs *QofObserver) handleFlow(fmap map[string]interface{}) error {
-
-	// turn the map into a flow, skip flows we don't care about
-	flow, err := flowFromMap(fmap, true, qobs.requiredDstPort)
-	if err != nil {
-		qobs.ignoredFlowCount++
-		return err
-	}
-
-	// extract addresses, reject reversed flows
-	source := flow.srcAddr.String()
-	qobs.sourceCounts[source]++
-
-	flowkey := flow.dstAddr.String()
-
-	if qobs.handledFlowCount > qobs.sourceRejectThreshold &&
-		qobs.sourceCounts[flowkey] > qobs.sourceRejectThreshold/2 {
-		qobs.ignoredFlowCount++
-		return errors.New("ignoring reversed flow")
-	}
-
-	qobs.handledFlowCount++
-
-	// determine whether the flow is an ECN attempt or not
-	if flow.ecnAttempted {
-		ecnflow := flow
-		if tcpflow, ok := qobs.pendingTCPFlows[flowkey]; ok {
-			return qobs.matchFlows(flowkey, tcpflow, ecnflow)
-		} else {
-			qobs.pendingECNFlows[flowkey] = ecnflow
-		}
-	} else {
-		tcpflow := flow
-		if ecnflow, ok := qobs.pendingECNFlows[flowkey]; ok {
-			return qobs.matchFlows(flowkey, tcpflow, ecnflow)
-		} else {
-			qobs.pendingTCPFlows[flowkey] = tcpflow
-		}
-	}
-
-	return nil
-}
-
-func normalizeQoF(in io.Reader, metain io.Reader, out io.Writer) error {
+func normalizeQoF(in io.Reader, metain io.Reader, out io.Writer, trace io.Writer) error {
 	// unmarshal metadata into an RDS metadata object
 	md, err := pto3.RawMetadataFromReader(metain, nil)
 	if err != nil {
 		return fmt.Errorf("could not read metadata: %s", err.Error())
 	}
 
-	var r io.Reader
-	s := ipfix.NewSession()
+	// check filetype and decompress if necessary
+	r, filetype, err := ecn.OpenInput(in, md.Filetype(true))
+	if err != nil {
+		return err
+	}
 
-	switch md.Filetype(true) {
-	case "ecnspider-qof-ipfix":
-		r = in
-	case "ecnspider-qof-ipfix-bz2":
-		r = bzip2.NewReader(in)
-	default:
+	if filetype != "ecnspider-qof-ipfix" {
 		return fmt.Errorf("unsupported filetype %s", md.Filetype(true))
 	}
 
 	// create an extractor around the output stream and initialize it with metadata
-	qobs := NewQofObserver()
-	qobs.out = out
-	qobs.sourceOverride = md.Get("source_override", true)
-	qobs.sourcePrepend = md.Get("source_prepend", true)
-	dstPort64, _ := strconv.ParseUint(md.Get("dst_port", true), 10, 16)
-	qobs.requiredDstPort = uint16(dstPort64)
+	qobs, err := ecn.NewQofObserver(out, md)
+	if err != nil {
+		return err
+	}
+	qobs.SetTrace(trace)
 
 	// get IPFIX session and intepreter
 	s, i := qofSession()
@@ -516,67 +214,109 @@ func normalizeQoF(in io.Reader, metain io.Reader, out io.Writer) error {
 				}
 			}
 
-			qobs.handleFlow(mrec)
-			if qobs.handledFlowCount%1000 == 0 {
-				log.Printf("ignored %d handled %d pending TCP %d pending ECN %d\n",
-					qobs.ignoredFlowCount,
-					qobs.handledFlowCount,
-					len(qobs.pendingTCPFlows),
-					len(qobs.pendingECNFlows))
+			if err := qobs.HandleFlow(mrec); err != nil {
+				return err
+			}
+			if qobs.HandledFlowCount()%1000 == 0 {
+				qobs.LogStatus()
 			}
 
 		}
 	}
 
 	// dump pending flows?
-	log.Printf("%d pending TCP flows, %d pending ECN flows", len(qobs.pendingTCPFlows), len(qobs.pendingECNFlows))
+	qobs.LogStatus()
 
 	// now write metadata
-	mdout := make(map[string]interface{})
-	mdcond := make([]string, 0)
+	return qobs.WriteMetadata(md, metadataURL)
+}
 
-	// copy all aux metadata from the raw file
-	for k := range md.Metadata {
-		mdout[k] = md.Metadata[k]
-	}
+var traceFlag = flag.String("trace", "", "write a per-flow debug trace as NDJSON to `file`")
+var traceFdFlag = flag.Int("trace-fd", -1, "write a per-flow debug trace as NDJSON to file descriptor `fd`")
 
-	// create condition list from observed conditions
-	for k := range qobs.hasCondition {
-		mdcond = append(mdcond, k)
+var validateFlag = flag.Bool("validate", false, "check metadata against raw data and report mismatches as JSON instead of normalizing")
+
+var normalizerFlags = ecn.NewNormalizerFlags()
+
+// descriptor describes this normalizer to the PTO
+func descriptor() *ecn.Descriptor {
+	return &ecn.Descriptor{
+		Owner:       ecn.DescriptorOwner,
+		Description: "A normalizer to extract ECN observations from QoF IPFIX files generated during runs of ECNSpider",
+		FileTypes:   ecn.CompressedFiletypes(ecn.FiletypeQoF),
+		Conditions:  ecn.QofConditions(),
+		Platform:    ecn.DescriptorPlatform,
+		Invocation:  "ecn_qof_normalizer",
 	}
-	mdout["_conditions"] = mdcond
+}
 
-	// add start and end time and owner, since we have it
-	mdout["_owner"] = md.Owner(true)
-	mdout["_time_start"] = md.TimeStart(true).Format(time.RFC3339)
-	mdout["_time_end"] = md.TimeEnd(true).Format(time.RFC3339)
+var descriptorFlags = ecn.NewDescriptorFlags()
 
-	// hardcode analyzer path (FIXME, tag?)
-	mdout["_analyzer"] = "https://raw.githubusercontent.com/mami-project/pto3-ecn/master/ecn_qof_normalizer/ecn_qof_normalizer.json"
+// run normalizes and returns the exit status, leaving exit to main so that
+// the output and trace files are closed on every path.
+func run() int {
+	// describe this normalizer instead of running if requested
+	if descriptorFlags.Requested() {
+		ok, err := descriptorFlags.Run(descriptor(), os.Stdout)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if !ok {
+			return 1
+		}
+		return 0
+	}
 
-	// serialize and write to stdout
-	b, err := json.Marshal(mdout)
+	// open input, metadata and output streams
+	nio, err := normalizerFlags.Open()
 	if err != nil {
-		return fmt.Errorf("error marshaling metadata: %s", err.Error())
+		log.Print(err)
+		return 1
 	}
+	defer nio.Close()
 
-	if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
-		return fmt.Errorf("error writing metadata: %s", err.Error())
+	// check metadata against content instead of normalizing if requested
+	if *validateFlag {
+		valid, err := ecn.ValidateInput(nio.In, nio.Meta, nio.Out, []string{ecn.FiletypeQoF})
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if !valid {
+			return 1
+		}
+		return 0
 	}
 
-	// all done yay
-	return nil
-}
-
-func main() {
-	// force UTC (only works on Unix)
-	os.Setenv("TZ", "")
-
-	// wrap a file around the metadata stream
-	mdfile := os.NewFile(3, ".piped_metadata.json")
+	// open the trace side channel if requested
+	var trace io.Writer
+	if *traceFlag != "" {
+		tracefile, err := os.Create(*traceFlag)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer tracefile.Close()
+		trace = tracefile
+	} else if *traceFdFlag >= 0 {
+		trace = os.NewFile(uintptr(*traceFdFlag), ".piped_trace.ndjson")
+	}
 
 	// and go
-	if err := normalizeQoF(os.Stdin, mdfile, os.Stdout); err != nil {
-		log.Fatal(err)
+	normalize := func(in io.Reader, metain io.Reader, out io.Writer) error {
+		return normalizeQoF(in, metain, out, trace)
+	}
+
+	if err := ecn.NormalizeInput(nio.In, nio.Meta, nio.Out, normalize); err != nil {
+		log.Print(err)
+		return 1
 	}
+
+	return 0
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
 }
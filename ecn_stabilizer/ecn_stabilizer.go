@@ -6,6 +6,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -15,19 +16,47 @@ import (
 	pto3 "github.com/mami-project/pto3-go"
 )
 
+// conditions generated by the stabilizer
+const (
+	condConnStableWorks     = "ecn.stable.connectivity.works"
+	condConnStableBroken    = "ecn.stable.connectivity.broken"
+	condConnStableOffline   = "ecn.stable.connectivity.offline"
+	condConnStableTransient = "ecn.stable.connectivity.transient"
+	condConnUnstable        = "ecn.stable.connectivity.unstable"
+
+	condNegoStableWorks     = "ecn.stable.negotiation.succeeded"
+	condNegoStableFailed    = "ecn.stable.negotiation.failed"
+	condNegoStableReflected = "ecn.stable.negotiation.reflected"
+	condNegoUnstable        = "ecn.stable.negotiation.unstable"
+)
+
+// stableConditions lists the conditions generated by the stabilizer, for
+// the descriptor
+var stableConditions = []string{
+	condConnStableWorks,
+	condConnStableBroken,
+	condConnStableOffline,
+	condConnStableTransient,
+	condConnUnstable,
+	condNegoStableWorks,
+	condNegoStableFailed,
+	condNegoStableReflected,
+	condNegoUnstable,
+}
+
 func stabilizeECN(in io.Reader, out io.Writer) error {
 
 	// create some conditions
-	connStableWorks := pto3.NewCondition("ecn.stable.connectivity.works")
-	connStableBroken := pto3.NewCondition("ecn.stable.connectivity.broken")
-	connStableOffline := pto3.NewCondition("ecn.stable.connectivity.offline")
-	connStableTransient := pto3.NewCondition("ecn.stable.connectivity.transient")
-	connUnstable := pto3.NewCondition("ecn.stable.connectivity.unstable")
+	connStableWorks := pto3.NewCondition(condConnStableWorks)
+	connStableBroken := pto3.NewCondition(condConnStableBroken)
+	connStableOffline := pto3.NewCondition(condConnStableOffline)
+	connStableTransient := pto3.NewCondition(condConnStableTransient)
+	connUnstable := pto3.NewCondition(condConnUnstable)
 
-	negoStableWorks := pto3.NewCondition("ecn.stable.negotiation.succeeded")
-	negoStableFailed := pto3.NewCondition("ecn.stable.negotiation.failed")
-	negoStableReflected := pto3.NewCondition("ecn.stable.negotiation.reflected")
-	negoUnstable := pto3.NewCondition("ecn.stable.negotiation.unstable")
+	negoStableWorks := pto3.NewCondition(condNegoStableWorks)
+	negoStableFailed := pto3.NewCondition(condNegoStableFailed)
+	negoStableReflected := pto3.NewCondition(condNegoStableReflected)
+	negoUnstable := pto3.NewCondition(condNegoUnstable)
 
 	// create a table mapping targets to condition counters
 	stableTable := make(map[string]*ecn.CondCount)
@@ -156,7 +185,35 @@ func stabilizeECN(in io.Reader, out io.Writer) error {
 	return nil
 }
 
+// descriptor describes this analyzer to the PTO
+func descriptor() *ecn.Descriptor {
+	return &ecn.Descriptor{
+		Owner:            ecn.DescriptorOwner,
+		Description:      "An analyzer to combine multiple ECN observations from related sources of identical targets in order to reduce the noise floor",
+		RequiresMetadata: []string{"vantage"},
+		Conditions:       stableConditions,
+		Platform:         ecn.DescriptorPlatform,
+		Invocation:       "ecn_stabilizer",
+	}
+}
+
+var descriptorFlags = ecn.NewDescriptorFlags()
+
 func main() {
+	flag.Parse()
+
+	// describe this analyzer instead of running if requested
+	if descriptorFlags.Requested() {
+		ok, err := descriptorFlags.Run(descriptor(), os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// just wrap stdin and stdout and go
 	if err := stabilizeECN(os.Stdin, os.Stdout); err != nil {
 		log.Fatal(err)
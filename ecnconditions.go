@@ -0,0 +1,101 @@
+package ecn
+
+// ECNPair summarizes a pair of connection attempts to the same target, one
+// without and one with ECN, as needed to derive ECN conditions. It is filled
+// in from QoF flows by the QoF and pcap normalizers, and from PathSpider flow
+// results when recomputing PathSpider's conditions.
+type ECNPair struct {
+	// PlainEstablished is true if the connection without ECN was established
+	PlainEstablished bool
+	// ECNEstablished is true if the connection with ECN was established
+	ECNEstablished bool
+	// ECNSynMalformed is true if the ECN setup SYN carried only one of ECE
+	// and CWR, and as such was not an ECN setup attempt
+	ECNSynMalformed bool
+	// ECNFallback is true if the ECN setup SYN went unanswered and the
+	// connection was retried with a plain SYN
+	ECNFallback bool
+	// Negotiated is true if the ECN SYN-ACK carried ECE but not CWR
+	Negotiated bool
+	// Reflected is true if the ECN SYN-ACK carried both ECE and CWR
+	Reflected bool
+	// ECT0, ECT1 and CE are true if the respective IP ECN mark was seen on
+	// the reverse direction of the ECN connection
+	ECT0 bool
+	ECT1 bool
+	CE   bool
+}
+
+// ECNPairConditions lists every condition ECNPair.Conditions may return.
+var ECNPairConditions = []string{
+	"ecn.connectivity.works",
+	"ecn.connectivity.broken",
+	"ecn.connectivity.transient",
+	"ecn.connectivity.offline",
+	"ecn.negotiation.succeeded",
+	"ecn.negotiation.failed",
+	"ecn.negotiation.reflected",
+	"ecn.negotiation.not_attempted",
+	"ecn.ipmark.ect0.seen",
+	"ecn.ipmark.ect0.not_seen",
+	"ecn.ipmark.ect1.seen",
+	"ecn.ipmark.ect1.not_seen",
+	"ecn.ipmark.ce.seen",
+	"ecn.ipmark.ce.not_seen",
+}
+
+// ECNFallbackCondition is the only condition generated for a pair whose ECN
+// connection fell back to a plain SYN.
+const ECNFallbackCondition = "ecn.connectivity.fallback"
+
+// Conditions returns the connectivity, negotiation and IP mark conditions
+// for a pair of connection attempts.
+func (p *ECNPair) Conditions() []string {
+	// a malformed ECN setup is not an attempt, and says nothing about ECN
+	// connectivity or marks
+	if p.ECNSynMalformed {
+		return []string{"ecn.negotiation.not_attempted"}
+	}
+
+	// a fallback was an attempt, but the connection was made without ECN
+	if p.ECNFallback {
+		return []string{ECNFallbackCondition}
+	}
+
+	var connectivityCondition string
+	switch {
+	case p.PlainEstablished && p.ECNEstablished:
+		connectivityCondition = "ecn.connectivity.works"
+	case p.PlainEstablished && !p.ECNEstablished:
+		connectivityCondition = "ecn.connectivity.broken"
+	case !p.PlainEstablished && p.ECNEstablished:
+		connectivityCondition = "ecn.connectivity.transient"
+	default:
+		connectivityCondition = "ecn.connectivity.offline"
+	}
+
+	var negotiationCondition string
+	switch {
+	case p.Negotiated:
+		negotiationCondition = "ecn.negotiation.succeeded"
+	case p.Reflected:
+		negotiationCondition = "ecn.negotiation.reflected"
+	default:
+		negotiationCondition = "ecn.negotiation.failed"
+	}
+
+	return []string{
+		connectivityCondition,
+		negotiationCondition,
+		markCondition("ecn.ipmark.ect0", p.ECT0),
+		markCondition("ecn.ipmark.ect1", p.ECT1),
+		markCondition("ecn.ipmark.ce", p.CE),
+	}
+}
+
+func markCondition(aspect string, seen bool) string {
+	if seen {
+		return aspect + ".seen"
+	}
+	return aspect + ".not_seen"
+}
@@ -0,0 +1,179 @@
+// ensequence packs a directory of raw data files and their metadata into a
+// Hadoop SequenceFile, the reverse of desequence. Each file is stored under
+// its path relative to the directory as key, and its metadata under the same
+// key with the suffix .meta.json, immediately before it, so that the
+// normalizers can read the SequenceFile directly.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/colinmarc/sequencefile"
+
+	ecn "github.com/mami-project/pto3-ecn"
+)
+
+var outFlag = flag.String("o", "", "write sequence file to `file`")
+var compressionFlag = flag.String("compression", "block", "compression `type`: none, record or block")
+var codecFlag = flag.String("codec", "gzip", "compression `codec`: gzip, snappy or zlib")
+var blockSizeFlag = flag.Int("block-size", 0, "with block compression, target uncompressed block size in `bytes`")
+
+var compressionTypes = map[string]sequencefile.Compression{
+	"none":   sequencefile.NoCompression,
+	"record": sequencefile.RecordCompression,
+	"block":  sequencefile.BlockCompression,
+}
+
+var compressionCodecs = map[string]sequencefile.CompressionCodec{
+	"gzip":   sequencefile.GzipCompression,
+	"snappy": sequencefile.SnappyCompression,
+	"zlib":   sequencefile.ZlibCompression,
+}
+
+// rawFilesIn lists the raw data files in a directory tree by key, skipping
+// metadata and hidden files, and the file named by exclude if it exists, so
+// that an archive written into the tree it packs is not packed into itself on
+// the next run. Keys are relative paths with forward slashes.
+func rawFilesIn(dir string, exclude string) ([]string, error) {
+	var out []string
+
+	excludeInfo, err := os.Stat(exclude)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() || strings.HasSuffix(name, ecn.EntryMetadataSuffix) {
+			return nil
+		}
+
+		if excludeInfo != nil && os.SameFile(info, excludeInfo) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		out = append(out, filepath.ToSlash(rel))
+
+		return nil
+	})
+
+	sort.Strings(out)
+	return out, err
+}
+
+// appendFile appends a file to a sequence file under a key.
+func appendFile(sw *sequencefile.Writer, key string, filename string) error {
+	value, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	return sw.Append(key, value)
+}
+
+func ensequence(dir string, out string, compression sequencefile.Compression, codec sequencefile.CompressionCodec, blockSize int) error {
+	keys, err := rawFilesIn(dir, out)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sw, err := sequencefile.NewWriter(&sequencefile.WriterOptions{
+		Writer:           f,
+		Compression:      compression,
+		CompressionCodec: codec,
+		BlockSize:        blockSize,
+		KeyClass:         sequencefile.TextClassName,
+		ValueClass:       sequencefile.BytesWritableClassName,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		filename := filepath.Join(dir, filepath.FromSlash(key))
+
+		// metadata goes first, so it is available when the entry is read
+		metafilename := filename + ecn.EntryMetadataSuffix
+		if _, err := os.Stat(metafilename); err == nil {
+			if err := appendFile(sw, key+ecn.EntryMetadataSuffix, metafilename); err != nil {
+				return err
+			}
+		} else if os.IsNotExist(err) {
+			log.Printf("no metadata for %s", key)
+		} else {
+			return err
+		}
+
+		log.Printf("packing %s", key)
+
+		if err := appendFile(sw, key, filename); err != nil {
+			return err
+		}
+	}
+
+	if err := sw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: pack raw data files and metadata into a sequence file\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -o file.seq [-compression type] [-codec codec] [-block-size bytes] directory\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) != 1 || *outFlag == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	compression, ok := compressionTypes[*compressionFlag]
+	if !ok {
+		log.Fatalf("unsupported compression type %s", *compressionFlag)
+	}
+
+	codec, ok := compressionCodecs[*codecFlag]
+	if !ok {
+		log.Fatalf("unsupported compression codec %s", *codecFlag)
+	}
+
+	if err := ensequence(args[0], *outFlag, compression, codec, *blockSizeFlag); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/colinmarc/sequencefile"
+
+	ecn "github.com/mami-project/pto3-ecn"
+)
+
+func writeTestFile(t *testing.T, filename string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ensequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rawdir := filepath.Join(dir, "raw")
+
+	// keys of 32 to 127 bytes have a printable length prefix as Text
+	entries := map[string]string{
+		"short.ndjson": "{\"sip\": \"192.0.2.1\"}\n",
+		"campaign-2018-03-01/vantage-a/pathspider-run-000001.ndjson": "{\"sip\": \"192.0.2.2\"}\n",
+	}
+
+	for key, content := range entries {
+		filename := filepath.Join(rawdir, filepath.FromSlash(key))
+		writeTestFile(t, filename, content)
+		writeTestFile(t, filename+ecn.EntryMetadataSuffix, `{"vantage": "`+key+`"}`)
+	}
+
+	seqfile := filepath.Join(dir, "raw.seq")
+	if err := ensequence(rawdir, seqfile, sequencefile.NoCompression, sequencefile.GzipCompression, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, content := range entries {
+		// normalizer input sees the unwrapped value and the entry metadata
+		f, err := os.Open(seqfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var gotContent []byte
+		var gotMetadata map[string]interface{}
+		normalize := func(in io.Reader, metain io.Reader, out io.Writer) error {
+			var err error
+			if gotContent, err = ioutil.ReadAll(in); err != nil {
+				return err
+			}
+			return json.NewDecoder(metain).Decode(&gotMetadata)
+		}
+
+		container := strings.NewReader(`{"sequencefile_key": "` + key + `"}`)
+		err = ecn.NormalizeInput(f, container, ioutil.Discard, normalize)
+		f.Close()
+		if err != nil {
+			t.Fatalf("normalizing %s: %s", key, err.Error())
+		}
+
+		if string(gotContent) != content {
+			t.Errorf("normalizer input for %s: got %q, want %q", key, gotContent, content)
+		}
+		if gotMetadata["vantage"] != key {
+			t.Errorf("entry metadata for %s not applied: got %v", key, gotMetadata)
+		}
+
+		// extraction sees the unwrapped value
+		sf, err := sequencefile.Open(seqfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		err = ecn.ExtractSequenceEntry(sf, key, &out)
+		sf.Close()
+		if err != nil {
+			t.Fatalf("extracting %s: %s", key, err.Error())
+		}
+
+		if out.String() != content {
+			t.Errorf("extracted %s: got %q, want %q", key, out.String(), content)
+		}
+	}
+}
+
+func TestRawFilesInSkipsOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ensequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "a.ndjson"), "{}\n")
+	writeTestFile(t, filepath.Join(dir, "a.ndjson"+ecn.EntryMetadataSuffix), "{}")
+	writeTestFile(t, filepath.Join(dir, ".hidden"), "")
+	writeTestFile(t, filepath.Join(dir, "raw.seq"), "SEQ")
+
+	// the output may be named by a different path to the same file
+	link := filepath.Join(dir, ".link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		exclude string
+		want    []string
+	}{
+		{filepath.Join(dir, "raw.seq"), []string{"a.ndjson"}},
+		{filepath.Join(link, "raw.seq"), []string{"a.ndjson"}},
+		{filepath.Join(dir, "new.seq"), []string{"a.ndjson", "raw.seq"}},
+	}
+
+	for _, test := range tests {
+		got, err := rawFilesIn(dir, test.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("excluding %s: got %v, want %v", test.exclude, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package ecn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// RecordError is an error in a single raw record. The reason is a short
+// identifier used to count skipped records.
+type RecordError struct {
+	Reason string
+	Err    error
+
+	// always skip the record, whatever the error policy
+	skip bool
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err.Error())
+}
+
+// NewRecordError wraps an error in a raw record with a reason.
+func NewRecordError(reason string, err error) error {
+	return &RecordError{Reason: reason, Err: err}
+}
+
+// NewSkippedRecordError wraps an error in a raw record with a reason, such
+// that the record is always skipped without counting against the budget.
+func NewSkippedRecordError(reason string, err error) error {
+	return &RecordError{Reason: reason, Err: err, skip: true}
+}
+
+// ErrorBudget implements an error policy for malformed raw records: abort on
+// the first error, skip all malformed records, or skip up to a maximum count
+// or fraction of records. It is safe for concurrent use.
+type ErrorBudget struct {
+	lock sync.Mutex
+
+	skip        bool
+	maxCount    int
+	maxFraction float64
+	hasFraction bool
+
+	recordCount  int
+	skippedCount int
+
+	reject io.Writer
+}
+
+// NewErrorBudget creates an error budget from the error_policy key in raw
+// metadata, which may be "abort" (the default), "skip", "skip:N" to skip up to
+// N records, or "skip:X%" to skip up to X percent of records.
+func NewErrorBudget(md *pto3.RawMetadata) (*ErrorBudget, error) {
+	eb := new(ErrorBudget)
+	eb.maxCount = -1
+
+	policy := md.Get("error_policy", true)
+
+	switch {
+	case policy == "" || policy == "abort":
+		eb.skip = false
+	case policy == "skip":
+		eb.skip = true
+	case strings.HasPrefix(policy, "skip:") && strings.HasSuffix(policy, "%"):
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(policy, "skip:"), "%"), 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("bad error policy %s", policy)
+		}
+		eb.skip = true
+		eb.maxFraction = pct / 100
+		eb.hasFraction = true
+
+		// nothing to wait for if no records may be skipped
+		if pct == 0 {
+			eb.maxCount = 0
+		}
+	case strings.HasPrefix(policy, "skip:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(policy, "skip:"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad error policy %s", policy)
+		}
+		eb.skip = true
+		eb.maxCount = n
+	default:
+		return nil, fmt.Errorf("unsupported error policy %s", policy)
+	}
+
+	return eb, nil
+}
+
+// Deferred returns true if the policy can only be checked once all records
+// have been handled, so output should be held back until Check succeeds.
+func (eb *ErrorBudget) Deferred() bool {
+	return eb.hasFraction && eb.maxFraction > 0
+}
+
+// SetReject sets a stream to which the raw content of each skipped record is
+// written, one per line.
+func (eb *ErrorBudget) SetReject(reject io.Writer) {
+	eb.reject = reject
+}
+
+// Record counts a record against the budget.
+func (eb *ErrorBudget) Record() {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	eb.recordCount++
+}
+
+// Skip handles an error in a record. It returns nil if the record may be
+// skipped, or an error if the policy requires the normalizer to abort. The
+// reason the record was skipped is returned as well.
+func (eb *ErrorBudget) Skip(rec []byte, err error) (string, error) {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	reason := "other"
+	always := false
+	if recerr, ok := err.(*RecordError); ok {
+		reason = recerr.Reason
+		always = recerr.skip
+	}
+
+	if !always {
+		if !eb.skip {
+			return reason, err
+		}
+
+		eb.skippedCount++
+		if eb.maxCount >= 0 && eb.skippedCount > eb.maxCount {
+			return reason, fmt.Errorf("more than %d malformed records, last: %s", eb.maxCount, err.Error())
+		}
+	}
+
+	if eb.reject != nil {
+		if _, err := fmt.Fprintf(eb.reject, "%s\n", rec); err != nil {
+			return reason, fmt.Errorf("error writing rejected record: %s", err.Error())
+		}
+	}
+
+	return reason, nil
+}
+
+// Check returns an error if the fraction of skipped records exceeds the
+// budget. It is called once all records have been handled.
+func (eb *ErrorBudget) Check() error {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+
+	if eb.hasFraction && eb.recordCount > 0 &&
+		float64(eb.skippedCount)/float64(eb.recordCount) > eb.maxFraction {
+		return fmt.Errorf("%d of %d records malformed, more than %.2f%%",
+			eb.skippedCount, eb.recordCount, eb.maxFraction*100)
+	}
+
+	return nil
+}
+
+// ScanNumberedLines returns a split function like bufio.ScanLines, which
+// prefixes each line with its line number and a tab. Records are handled
+// concurrently, so this is the only place the line number is known; the
+// wrapper installed by QualityStats.Wrap removes it again.
+func ScanNumberedLines() bufio.SplitFunc {
+	lineno := 0
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if err != nil || token == nil {
+			return advance, token, err
+		}
+
+		// pass empty lines on as they are, for the scanner to handle
+		lineno++
+		if len(token) == 0 {
+			return advance, token, nil
+		}
+
+		return advance, append([]byte(strconv.Itoa(lineno)+"\t"), token...), nil
+	}
+}
+
+// splitLineNumber removes the line number added by ScanNumberedLines from a
+// record. Records without one are returned as they are, with line number 0.
+func splitLineNumber(rec []byte) (int, []byte) {
+	i := bytes.IndexByte(rec, '\t')
+	if i <= 0 {
+		return 0, rec
+	}
+
+	lineno, err := strconv.Atoi(string(rec[:i]))
+	if err != nil {
+		return 0, rec
+	}
+
+	return lineno, rec[i+1:]
+}
+
+// MergeCounts merges metadata from a single record into accumulated
+// metadata, summing integer counts and replacing any other values.
+func MergeCounts(in map[string]interface{}, accumulator map[string]interface{}) {
+	for k, v := range in {
+		n, ok := v.(int)
+		if !ok {
+			accumulator[k] = v
+			continue
+		}
+
+		if m, ok := accumulator[k].(int); ok {
+			accumulator[k] = m + n
+		} else {
+			accumulator[k] = n
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package ecn
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func testMetadata(t *testing.T, js string) *pto3.RawMetadata {
+	t.Helper()
+	md, err := pto3.RawMetadataFromReader(strings.NewReader(js), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return md
+}
+
+func TestErrorBudget(t *testing.T) {
+	tests := []struct {
+		policy    string
+		records   int
+		malformed int
+		badPolicy bool
+		deferred  bool
+		abortAt   int // number of malformed records at which Skip fails, 0 for never
+		checkFail bool
+	}{
+		{policy: "", records: 10, malformed: 1, abortAt: 1},
+		{policy: "abort", records: 10, malformed: 1, abortAt: 1},
+		{policy: "skip", records: 10, malformed: 10},
+		{policy: "skip:2", records: 10, malformed: 2},
+		{policy: "skip:2", records: 10, malformed: 3, abortAt: 3},
+		{policy: "skip:0", records: 10, malformed: 1, abortAt: 1},
+		{policy: "skip:0%", records: 10, malformed: 1, abortAt: 1},
+		{policy: "skip:0%", records: 10, malformed: 0},
+		{policy: "skip:10%", records: 10, malformed: 1, deferred: true},
+		{policy: "skip:10%", records: 10, malformed: 2, deferred: true, checkFail: true},
+		{policy: "skip:100%", records: 10, malformed: 10, deferred: true},
+		{policy: "skip:-1", badPolicy: true},
+		{policy: "skip:x", badPolicy: true},
+		{policy: "skip:101%", badPolicy: true},
+		{policy: "skip:x%", badPolicy: true},
+		{policy: "ignore", badPolicy: true},
+	}
+
+	for _, test := range tests {
+		eb, err := NewErrorBudget(testMetadata(t, `{"error_policy": "`+test.policy+`"}`))
+		if test.badPolicy {
+			if err == nil {
+				t.Errorf("policy %q: expected error", test.policy)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("policy %q: %s", test.policy, err.Error())
+			continue
+		}
+
+		if eb.Deferred() != test.deferred {
+			t.Errorf("policy %q: deferred %v, want %v", test.policy, eb.Deferred(), test.deferred)
+		}
+
+		abortAt := 0
+		for i := 0; i < test.records; i++ {
+			eb.Record()
+			if i >= test.malformed {
+				continue
+			}
+			if _, err := eb.Skip([]byte("{"), NewRecordError("json", errors.New("bad"))); err != nil && abortAt == 0 {
+				abortAt = i + 1
+			}
+		}
+
+		if abortAt != test.abortAt {
+			t.Errorf("policy %q: aborted at malformed record %d, want %d", test.policy, abortAt, test.abortAt)
+		}
+
+		// normalization stops at the first abort, so there's nothing to check
+		if abortAt > 0 {
+			continue
+		}
+
+		if err := eb.Check(); (err != nil) != test.checkFail {
+			t.Errorf("policy %q: check returned %v, want failure %v", test.policy, err, test.checkFail)
+		}
+	}
+}
+
+func TestErrorBudgetAlwaysSkip(t *testing.T) {
+	eb, err := NewErrorBudget(testMetadata(t, `{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reject bytes.Buffer
+	eb.SetReject(&reject)
+
+	reason, err := eb.Skip([]byte("{bad}"), NewSkippedRecordError("address", errors.New("bad")))
+	if err != nil {
+		t.Fatalf("skipped record aborted under abort policy: %s", err.Error())
+	}
+	if reason != "address" {
+		t.Errorf("reason %s, want address", reason)
+	}
+	if reject.String() != "{bad}\n" {
+		t.Errorf("rejected %q, want the record", reject.String())
+	}
+
+	if reason, _ := eb.Skip(nil, errors.New("bad")); reason != "other" {
+		t.Errorf("reason %s for plain error, want other", reason)
+	}
+}
+
+func TestScanNumberedLines(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("{\"a\": 1}\n\n{\"b\": 2}\r\n"))
+	scanner.Split(ScanNumberedLines())
+
+	tests := []struct {
+		lineno int
+		rec    string
+	}{
+		{1, "{\"a\": 1}"},
+		{0, ""},
+		{3, "{\"b\": 2}"},
+	}
+
+	for _, test := range tests {
+		if !scanner.Scan() {
+			t.Fatalf("expected line %d", test.lineno)
+		}
+		lineno, rec := splitLineNumber(scanner.Bytes())
+		if lineno != test.lineno || string(rec) != test.rec {
+			t.Errorf("got line %d %q, want line %d %q", lineno, rec, test.lineno, test.rec)
+		}
+	}
+
+	if scanner.Scan() {
+		t.Errorf("unexpected line %q", scanner.Text())
+	}
+}
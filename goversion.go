@@ -0,0 +1,10 @@
+//go:build go1.18
+// +build go1.18
+
+package ecn
+
+// goPlatform names the oldest Go release this repository builds with, as
+// declared by the build constraint on this file (net/netip is new in Go 1.18).
+// Older toolchains skip the file and fail on the missing constant, so raise
+// both together.
+const goPlatform = "golang-1.18"
@@ -0,0 +1,113 @@
+package ecn
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression codecs supported for raw data
+const (
+	CodecNone  = ""
+	CodecBzip2 = "bzip2"
+	CodecGzip  = "gzip"
+	CodecXz    = "xz"
+	CodecZstd  = "zstd"
+)
+
+// CompressionSuffixes maps filetype suffixes to the codec they imply.
+var CompressionSuffixes = map[string]string{
+	"-bz2": CodecBzip2,
+	"-gz":  CodecGzip,
+	"-xz":  CodecXz,
+	"-zst": CodecZstd,
+}
+
+var codecMagic = []struct {
+	codec string
+	magic []byte
+}{
+	{CodecBzip2, []byte("BZh")},
+	{CodecGzip, []byte{0x1f, 0x8b}},
+	{CodecXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CodecZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// SplitFiletype splits a filetype into the base filetype and the codec implied
+// by its compression suffix, if any.
+func SplitFiletype(filetype string) (string, string) {
+	for suffix, codec := range CompressionSuffixes {
+		if strings.HasSuffix(filetype, suffix) {
+			return strings.TrimSuffix(filetype, suffix), codec
+		}
+	}
+	return filetype, CodecNone
+}
+
+// DetectCodec looks at the first few bytes of a stream to determine which
+// codec, if any, it is compressed with. It returns a reader that still
+// yields the whole stream.
+func DetectCodec(in io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(in)
+
+	for _, cm := range codecMagic {
+		magic, err := br.Peek(len(cm.magic))
+		if err != nil && err != io.EOF {
+			return nil, CodecNone, err
+		}
+
+		if bytes.Equal(magic, cm.magic) {
+			return br, cm.codec, nil
+		}
+	}
+
+	return br, CodecNone, nil
+}
+
+// Decompress wraps a stream in a decompressor for the given codec.
+func Decompress(in io.Reader, codec string) (io.Reader, error) {
+	switch codec {
+	case CodecNone:
+		return in, nil
+	case CodecBzip2:
+		return bzip2.NewReader(in), nil
+	case CodecGzip:
+		return gzip.NewReader(in)
+	case CodecXz:
+		return xz.NewReader(in)
+	case CodecZstd:
+		return zstd.NewReader(in)
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %s", codec)
+	}
+}
+
+// OpenInput wraps a raw data stream of the given filetype in a decompressor
+// as necessary. The codec is determined from the compression suffix of the
+// filetype if it has one, or else detected from the content of the stream. It
+// returns the decompressed stream and the filetype without compression suffix.
+func OpenInput(in io.Reader, filetype string) (io.Reader, string, error) {
+	basetype, codec := SplitFiletype(filetype)
+
+	if codec == CodecNone {
+		var err error
+		in, codec, err = DetectCodec(in)
+		if err != nil {
+			return nil, basetype, fmt.Errorf("cannot read input: %s", err.Error())
+		}
+	}
+
+	r, err := Decompress(in, codec)
+	if err != nil {
+		return nil, basetype, fmt.Errorf("cannot decompress input: %s", err.Error())
+	}
+
+	return r, basetype, nil
+}
@@ -0,0 +1,115 @@
+package ecn
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// metadataFd is the file descriptor ptonorm passes raw metadata on
+const metadataFd = 3
+
+// NormalizerFlags are the flags common to all normalizers, selecting where
+// raw data and metadata are read from and observations written to. Without
+// them, normalizers follow the ptonorm contract: raw data on stdin, metadata
+// on file descriptor 3, and observations on stdout.
+type NormalizerFlags struct {
+	in   *string
+	meta *string
+	out  *string
+}
+
+// NewNormalizerFlags registers the -in, -meta and -out flags with the flag
+// package. It must be called before flag.Parse.
+func NewNormalizerFlags() *NormalizerFlags {
+	nf := new(NormalizerFlags)
+	nf.in = flag.String("in", "", "read raw data from `file` instead of stdin")
+	nf.meta = flag.String("meta", "", "read metadata from `file` instead of <in>.meta.json or fd 3")
+	nf.out = flag.String("out", "", "write observations to `file` instead of stdout")
+	return nf
+}
+
+// NormalizerIO holds the streams a normalizer reads and writes.
+type NormalizerIO struct {
+	In   io.Reader
+	Meta io.Reader
+	Out  io.Writer
+
+	closers []io.Closer
+}
+
+// Close closes any files opened for the streams.
+func (nio *NormalizerIO) Close() error {
+	var firstErr error
+	for _, c := range nio.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openMetadata opens the metadata stream: the file given with -meta, or else
+// the metadata file next to the raw data file given with -in if there is
+// one, or else file descriptor 3.
+func (nf *NormalizerFlags) openMetadata() (*os.File, error) {
+	if *nf.meta != "" {
+		return os.Open(*nf.meta)
+	}
+
+	if *nf.in != "" && *nf.in != "-" {
+		metafile, err := os.Open(*nf.in + EntryMetadataSuffix)
+		if err == nil {
+			return metafile, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	mdfile := os.NewFile(metadataFd, ".piped_metadata.json")
+	if _, err := mdfile.Stat(); err != nil {
+		return nil, fmt.Errorf("no metadata: use -meta, provide %s, or pipe metadata on fd %d",
+			"<in>"+EntryMetadataSuffix, metadataFd)
+	}
+
+	return mdfile, nil
+}
+
+// Open opens the streams selected by the flags.
+func (nf *NormalizerFlags) Open() (*NormalizerIO, error) {
+	nio := new(NormalizerIO)
+
+	if *nf.in == "" || *nf.in == "-" {
+		nio.In = os.Stdin
+	} else {
+		infile, err := os.Open(*nf.in)
+		if err != nil {
+			return nil, err
+		}
+		nio.In = infile
+		nio.closers = append(nio.closers, infile)
+	}
+
+	mdfile, err := nf.openMetadata()
+	if err != nil {
+		nio.Close()
+		return nil, err
+	}
+	nio.Meta = mdfile
+	nio.closers = append(nio.closers, mdfile)
+
+	if *nf.out == "" || *nf.out == "-" {
+		nio.Out = os.Stdout
+	} else {
+		outfile, err := os.Create(*nf.out)
+		if err != nil {
+			nio.Close()
+			return nil, err
+		}
+		nio.Out = outfile
+		nio.closers = append(nio.closers, outfile)
+	}
+
+	return nio, nil
+}
@@ -0,0 +1,73 @@
+package ecn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReadMetadataFile reads a raw metadata file into a map of keys to values.
+func ReadMetadataFile(filename string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", filename, err.Error())
+	}
+
+	return keys, nil
+}
+
+// WriteMetadataFile writes a raw metadata file from a map of keys to values.
+// The file is replaced atomically.
+func WriteMetadataFile(filename string, keys map[string]interface{}) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(filename, append(b, '\n'))
+}
+
+// writeFileAtomically writes data to a temporary file in the same directory
+// as filename first, then renames it, so that readers never see a partially
+// written file. The file keeps its mode if it exists, and is created 0644
+// otherwise.
+func writeFileAtomically(filename string, b []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+
+	// temporary files are created 0600
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
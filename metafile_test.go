@@ -0,0 +1,72 @@
+package ecn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteMetadataFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metafile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		existing os.FileMode // 0 if the file does not exist yet
+		want     os.FileMode
+	}{
+		{0, 0644},
+		{0640, 0640},
+		{0664, 0664},
+	}
+
+	keys := map[string]interface{}{"_file_type": "ecnspider-qof-ipfix", "vantage": "a"}
+
+	for i, test := range tests {
+		filename := filepath.Join(dir, "raw.ipfix.meta.json")
+		os.Remove(filename)
+
+		if test.existing != 0 {
+			if err := ioutil.WriteFile(filename, []byte("{}"), test.existing); err != nil {
+				t.Fatal(err)
+			}
+			// WriteFile is subject to the umask
+			if err := os.Chmod(filename, test.existing); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := WriteMetadataFile(filename, keys); err != nil {
+			t.Fatalf("%d: %s", i, err.Error())
+		}
+
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != test.want {
+			t.Errorf("%d: mode %v, want %v", i, fi.Mode().Perm(), test.want)
+		}
+
+		got, err := ReadMetadataFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, keys) {
+			t.Errorf("%d: read back %v, want %v", i, got, keys)
+		}
+	}
+
+	// no temporary files are left behind
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("expected only the metadata file, got %d files", len(names))
+	}
+}
@@ -0,0 +1,168 @@
+// mk_metadata creates PTO raw metadata for raw data files of any filetype
+// handled by the normalizers in this repository, compressed or not. It infers
+// the filetype, time range, source addresses and candidate vantage point,
+// destination ports and record count from the content of each file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ecn "github.com/mami-project/pto3-ecn"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// inferMetadata reads a raw data stream and returns inferred metadata. The
+// filetype is detected if not given. Existing metadata is used to configure
+// timestamp parsing.
+func inferMetadata(in io.Reader, filetype string, md *pto3.RawMetadata) (map[string]interface{}, error) {
+	rs, err := ecn.SummarizeRaw(in, filetype, md)
+	if err != nil {
+		return nil, err
+	}
+
+	if rs.MalformedCount > 0 {
+		log.Printf("skipped %d malformed records of %d", rs.MalformedCount, rs.RecordCount)
+	}
+
+	return rs.Metadata(), nil
+}
+
+// readExistingMetadata reads a metadata file if it exists, returning its keys
+// and its content as raw metadata.
+func readExistingMetadata(metafilename string) (map[string]interface{}, *pto3.RawMetadata, error) {
+	keys, err := ecn.ReadMetadataFile(metafilename)
+	if os.IsNotExist(err) {
+		keys = make(map[string]interface{})
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md, err := pto3.RawMetadataFromReader(bytes.NewReader(b), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse %s: %s", metafilename, err.Error())
+	}
+
+	return keys, md, nil
+}
+
+// writeMetadataFor infers metadata for a raw data file and writes it next to
+// the file, adding inferred keys not already present in existing metadata.
+func writeMetadataFor(filename string, filetype string) error {
+	metafilename := filename + ".meta.json"
+
+	keys, md, err := readExistingMetadata(metafilename)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	inferred, err := inferMetadata(in, filetype, md)
+	if err != nil {
+		return err
+	}
+
+	// keys set by hand or by assign_vantage take precedence over guesses
+	for k, v := range inferred {
+		if _, ok := keys[k]; !ok {
+			keys[k] = v
+		}
+	}
+
+	return ecn.WriteMetadataFile(metafilename, keys)
+}
+
+// rawFilesIn lists the raw data files in a directory tree, skipping metadata
+// and hidden files.
+func rawFilesIn(dir string) ([]string, error) {
+	var out []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() && !strings.HasSuffix(name, ".meta.json") {
+			out = append(out, path)
+		}
+
+		return nil
+	})
+
+	return out, err
+}
+
+var filetypeFlag = flag.String("filetype", "", "filetype of raw data `type`, detected if not given")
+
+func main() {
+	flag.Parse()
+
+	// without arguments, read raw data on stdin and write metadata to stdout
+	if flag.NArg() == 0 {
+		md, err := pto3.RawMetadataFromReader(strings.NewReader("{}"), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		inferred, err := inferMetadata(os.Stdin, *filetypeFlag, md)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		b, err := json.MarshalIndent(inferred, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Stdout.Write(append(b, '\n'))
+		return
+	}
+
+	// otherwise write metadata for each file given and in each directory
+	for _, arg := range flag.Args() {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filenames := []string{arg}
+		if fi.IsDir() {
+			if filenames, err = rawFilesIn(arg); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		for _, filename := range filenames {
+			log.Printf("processing %s", filename)
+			if err := writeMetadataFor(filename, *filetypeFlag); err != nil {
+				log.Fatalf("error processing %s: %s", filename, err.Error())
+			}
+		}
+	}
+}
@@ -1,14 +1,23 @@
+// normalize_pathspider is a local normalizer (for use with ptonorm) that
+// converts ndjson files from PathSpider version 1 (ECN plugin) and version 2
+// to PTO observations.
+
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/netip"
 	"os"
 	"strings"
 	"time"
 
+	ecn "github.com/mami-project/pto3-ecn"
 	pto3 "github.com/mami-project/pto3-go"
 )
 
@@ -22,8 +31,6 @@ var conditionFixTable = map[string]string{
 	"ecn.ce.seen":        "ecn.ipmark.ce.seen",
 }
 
-var timestampFormats = []string{"2006-01-02 15:04:05.000000", "2006-01-02 15:04:05"}
-
 func fixCondition(cond string) (string, string) {
 
 	// Split values at :
@@ -44,37 +51,103 @@ func fixCondition(cond string) (string, string) {
 	return cond, value
 }
 
+// isRecord returns true if a line looks like an NDJSON record; blank lines and
+// other junk between records are skipped.
+func isRecord(rec []byte) bool {
+	rec = bytes.TrimSpace(rec)
+	return len(rec) > 0 && rec[0] == '{'
+}
+
+// psNormalizer holds state shared by the record normalizers for a single file
+type psNormalizer struct {
+	timestamps *ecn.TimestampParser
+
+	// hostnameMode determines what is done with target hostnames in
+	// version 2 records
+	hostnameMode string
+
+	// quarantineAddresses is true if records with invalid addresses are to
+	// be dropped instead of treated as malformed
+	quarantineAddresses bool
+
+	// recomputeECN is true if ECN conditions in version 2 records are to be
+	// derived from flow results instead of taken from PathSpider
+	recomputeECN bool
+
+	// notSeenPlugins is the set of plugins for which not_seen conditions are
+	// synthesized
+	notSeenPlugins map[string]struct{}
+}
+
+// Hostname modes, selected with the hostname metadata key
+const (
+	hostnameDrop  = "drop"
+	hostnamePath  = "path"
+	hostnameValue = "value"
+)
+
+// timestampValue is a timestamp in a PathSpider record, which may be given
+// either as a string or as a number of seconds or milliseconds since the epoch.
+type timestampValue string
+
+func (tv *timestampValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*tv = timestampValue(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*tv = timestampValue(n.String())
+	return nil
+}
+
 type timestampPair struct {
-	From string `json:"from"`
-	To   string `json:"to"`
+	From timestampValue `json:"from"`
+	To   timestampValue `json:"to"`
 }
 
-func parseTimestamps(in timestampPair) (time.Time, time.Time, error) {
+func (psn *psNormalizer) parseTimestamps(in timestampPair) (time.Time, time.Time, error) {
 	var start, end time.Time
 	var err error
-	for _, timefmt := range timestampFormats {
-		start, err = time.Parse(timefmt, in.From)
-		if err == nil {
-			break
-		}
-	}
-	if err != nil {
+
+	if start, err = psn.timestamps.Parse(string(in.From)); err != nil {
 		return start, end, fmt.Errorf("cannot parse start time: %s", err.Error())
 	}
 
-	for _, timefmt := range timestampFormats {
-		end, err = time.Parse(timefmt, in.To)
-		if err == nil {
-			break
-		}
-	}
-	if err != nil {
+	if end, err = psn.timestamps.Parse(string(in.To)); err != nil {
 		return start, end, fmt.Errorf("cannot parse end time: %s", err.Error())
 	}
 
 	return start, end, nil
 }
 
+// invalidAddress handles an invalid address in a record according to the
+// invalid address policy: either the record is skipped, whatever the error
+// policy, or it is dropped and counted as quarantined in output metadata.
+func (psn *psNormalizer) invalidAddress(err error, mdout chan<- map[string]interface{}) ([]pto3.Observation, error) {
+	if psn.quarantineAddresses {
+		mdout <- map[string]interface{}{"quarantined_address_count": 1}
+		return nil, nil
+	}
+	return nil, ecn.NewSkippedRecordError("address", err)
+}
+
+// familyObservation creates an observation tagging a path with the address
+// family of its target.
+func familyObservation(start *time.Time, end *time.Time, path *pto3.Path, target netip.Addr) pto3.Observation {
+	var obs pto3.Observation
+	obs.TimeStart = start
+	obs.TimeEnd = end
+	obs.Path = path
+	obs.Condition = new(pto3.Condition)
+	obs.Condition.Name = ecn.FamilyCondition(target)
+	return obs
+}
+
 type psV1Observation struct {
 	Time       timestampPair `json:"time"`
 	Sip        string        `json:"sip"`
@@ -88,19 +161,24 @@ var psV1NotSeenECNAspects = map[string]struct{}{
 	"ecn.ipmark.ect1": struct{}{},
 }
 
-func normalizeV1(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]interface{}) ([]pto3.Observation, error) {
+func (psn *psNormalizer) normalizeV1(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]interface{}) ([]pto3.Observation, error) {
 	var psobs psV1Observation
 
+	// skip lines that aren't records, without counting them
+	if !isRecord(rec) {
+		return nil, ecn.ErrNotRecord
+	}
+
 	// parse ndjson line
 	if err := json.Unmarshal([]byte(rec), &psobs); err != nil {
-		return nil, err
+		return nil, ecn.NewRecordError("json", err)
 	}
 
 	// parse timestamps
 	var start, end time.Time
 	var err error
-	if start, end, err = parseTimestamps(psobs.Time); err != nil {
-		return nil, err
+	if start, end, err = psn.parseTimestamps(psobs.Time); err != nil {
+		return nil, ecn.NewRecordError("timestamp", err)
 	}
 
 	// make a path
@@ -108,11 +186,21 @@ func normalizeV1(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]int
 	sourcePrepend := mdin.Get("source_prepend", true)
 	path := new(pto3.Path)
 
+	target, err := ecn.CanonicalAddress(psobs.Dip)
+	if err != nil {
+		return psn.invalidAddress(err, mdout)
+	}
+	psobs.Dip = target.String()
+
 	var source string
 	if sourceOverride != "" {
 		source = sourceOverride
-	} else {
-		source = psobs.Sip
+	} else if psobs.Sip != "" {
+		sourceAddr, err := ecn.CanonicalAddress(psobs.Sip)
+		if err != nil {
+			return psn.invalidAddress(err, mdout)
+		}
+		source = sourceAddr.String()
 	}
 
 	var pathElements []string
@@ -151,9 +239,13 @@ func normalizeV1(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]int
 		}
 	}
 
+	// tag the path with the address family of the target
+	obsen = append(obsen, familyObservation(&start, &end, path, target))
+
 	// check aspects for marks we haven't seen and generate conditions
+	_, synthesize := psn.notSeenPlugins["ecn"]
 	for markAspect := range psV1NotSeenECNAspects {
-		if !ecnMarkSeen[markAspect] {
+		if synthesize && !ecnMarkSeen[markAspect] {
 			var notSeenObs pto3.Observation
 			notSeenObs.TimeStart = &start
 			notSeenObs.TimeEnd = &end
@@ -167,41 +259,65 @@ func normalizeV1(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]int
 }
 
 type psV2Observation struct {
-	Time struct {
-		From string `json:"from"`
-		To   string `json:"to"`
-	} `json:"time"`
-	Path       []string `json:"path"`
-	Conditions []string `json:"conditions"`
+	Time       timestampPair `json:"time"`
+	Path       []string      `json:"path"`
+	Conditions []string      `json:"conditions"`
 	CanidInfo  struct {
 		ASN uint32 `json:"ASN"`
 	} `json:"canid_info"`
+	FlowResults []psV2Flow `json:"flow_results"`
+	Hostname    string     `json:"hostname"`
+	Domain      string     `json:"domain"`
 }
 
-func normalizeV2(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]interface{}) ([]pto3.Observation, error) {
+func (psn *psNormalizer) normalizeV2(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]interface{}) ([]pto3.Observation, error) {
 	var psobs psV2Observation
 
+	// skip lines that aren't records, without counting them
+	if !isRecord(rec) {
+		return nil, ecn.ErrNotRecord
+	}
+
 	// parse ndjson line
 	if err := json.Unmarshal(rec, &psobs); err != nil {
-		return nil, err
+		return nil, ecn.NewRecordError("json", err)
 	}
 
 	// parse timestamps
 	var start, end time.Time
 	var err error
-	if start, end, err = parseTimestamps(psobs.Time); err != nil {
-		return nil, err
+	if start, end, err = psn.parseTimestamps(psobs.Time); err != nil {
+		return nil, ecn.NewRecordError("timestamp", err)
+	}
+
+	// hostname resolved to the target, from the input list or DNS
+	hostname := psobs.Hostname
+	if hostname == "" {
+		hostname = psobs.Domain
 	}
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
 
 	// edit path: source override and prepend,
 	// add * if missing, extract ASN from Canid information if present
 	sourceOverride := mdin.Get("source_override", true)
 	sourcePrepend := mdin.Get("source_prepend", true)
 
+	var target netip.Addr
 	if psobs.Path != nil && len(psobs.Path) >= 2 {
 		if sourceOverride != "" {
 			psobs.Path[0] = sourceOverride
+		} else {
+			sourceAddr, err := ecn.CanonicalAddress(psobs.Path[0])
+			if err != nil {
+				return psn.invalidAddress(err, mdout)
+			}
+			psobs.Path[0] = sourceAddr.String()
+		}
+
+		if target, err = ecn.CanonicalAddress(psobs.Path[len(psobs.Path)-1]); err != nil {
+			return psn.invalidAddress(err, mdout)
 		}
+		psobs.Path[len(psobs.Path)-1] = target.String()
 
 		if sourcePrepend != "" {
 			psobs.Path = append([]string{sourcePrepend}, psobs.Path...)
@@ -232,39 +348,295 @@ func normalizeV2(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]int
 			psobs.Path[len(psobs.Path)-1] = star
 			psobs.Path = append(psobs.Path, dip)
 		}
+
+		// insert hostname before the target if requested
+		if psn.hostnameMode == hostnamePath && hostname != "" {
+			dip := psobs.Path[len(psobs.Path)-1]
+			psobs.Path[len(psobs.Path)-1] = hostname
+			psobs.Path = append(psobs.Path, dip)
+		}
 	} else {
-		return nil, fmt.Errorf("bad or missing path")
+		return nil, ecn.NewRecordError("path", fmt.Errorf("bad or missing path"))
 	}
 
 	path := new(pto3.Path)
 	path.String = strings.Join(psobs.Path, " ")
 
-	// now create an observation for each condition
-	obsen := make([]pto3.Observation, len(psobs.Conditions))
+	// map conditions into the PTO namespace
+	conds := make([]string, len(psobs.Conditions))
+	values := make([]string, len(psobs.Conditions))
+	hasECN := false
+	undeclared := 0
 	for i, c := range psobs.Conditions {
+		var declared bool
+		if conds[i], values[i], declared = mapPluginCondition(fixCondition(c)); !declared {
+			undeclared++
+		}
+		if strings.HasPrefix(conds[i], "ecn.") {
+			hasECN = true
+		}
+	}
+
+	// pass undeclared conditions through, but count them
+	if undeclared > 0 {
+		mdout <- map[string]interface{}{"undeclared_condition_count": undeclared}
+	}
+
+	// replace ECN conditions with our own if requested
+	if psn.recomputeECN && hasECN {
+		var disagreements int
+		conds, values, disagreements, err = recomputeECNConditions(conds, values, psobs.FlowResults)
+		if err != nil {
+			// records without usable flow results are skipped, not fatal
+			return nil, ecn.NewSkippedRecordError("flows", err)
+		}
+		if disagreements > 0 {
+			mdout <- map[string]interface{}{"ecn_condition_disagreements": disagreements}
+		}
+	}
+
+	condsSeen := make(map[string]struct{})
+
+	// now create an observation for each condition
+	obsen := make([]pto3.Observation, len(conds))
+	for i := range conds {
 		obsen[i].TimeStart = &start
 		obsen[i].TimeEnd = &end
 		obsen[i].Path = path
 		obsen[i].Condition = new(pto3.Condition)
-		cond, value := fixCondition(c)
-		obsen[i].Condition.Name = cond
-		obsen[i].Value = value
+		obsen[i].Condition.Name = conds[i]
+		obsen[i].Value = values[i]
+
+		// use hostname as value if requested and there is no other
+		if psn.hostnameMode == hostnameValue && obsen[i].Value == "" {
+			obsen[i].Value = hostname
+		}
+
+		condsSeen[conds[i]] = struct{}{}
+	}
+
+	// tag the path with the address family of the target
+	if len(obsen) > 0 {
+		obsen = append(obsen, familyObservation(&start, &end, path, target))
+	}
+
+	// generate conditions for marks we haven't seen, as for version 1
+	for _, cond := range synthesizeNotSeen(condsSeen, psn.notSeenPlugins) {
+		var notSeenObs pto3.Observation
+		notSeenObs.TimeStart = &start
+		notSeenObs.TimeEnd = &end
+		notSeenObs.Path = path
+		notSeenObs.Condition = new(pto3.Condition)
+		notSeenObs.Condition.Name = cond
+		obsen = append(obsen, notSeenObs)
 	}
 
 	return obsen, nil
 }
 
-func main() {
-	// wrap a file around the metadata stream
-	mdfile := os.NewFile(3, ".piped_metadata.json")
+// normalizePathspider normalizes a PathSpider file. The metadata is read
+// first in order to configure the error policy and decompress the input before
+// handing both to a scanning normalizer. Raw records skipped under the error
+// policy are written to reject if it is not nil.
+func normalizePathspider(in io.Reader, metain io.Reader, out io.Writer, reject io.Writer) error {
+	// buffer metadata so we can look at it here and in the normalizer
+	mdbytes, err := ioutil.ReadAll(metain)
+	if err != nil {
+		return fmt.Errorf("could not read metadata: %s", err.Error())
+	}
+
+	md, err := pto3.RawMetadataFromReader(bytes.NewReader(mdbytes), nil)
+	if err != nil {
+		return fmt.Errorf("could not read metadata: %s", err.Error())
+	}
+
+	// set up the error policy
+	budget, err := ecn.NewErrorBudget(md)
+	if err != nil {
+		return err
+	}
+	budget.SetReject(reject)
+
+	// collect quality statistics for output metadata
+	quality := ecn.NewQualityStats()
+
+	// set up timestamp parsing
+	var psn psNormalizer
+	if psn.timestamps, err = ecn.NewTimestampParser(md); err != nil {
+		return err
+	}
+
+	// select what to do with invalid addresses
+	switch invalidAddress := md.Get("invalid_address", true); invalidAddress {
+	case "", "reject":
+		psn.quarantineAddresses = false
+	case "quarantine":
+		psn.quarantineAddresses = true
+	default:
+		return fmt.Errorf("unsupported invalid_address handling %s", invalidAddress)
+	}
+
+	// select what to do with hostnames
+	switch hostnameMode := md.Get("hostname", true); hostnameMode {
+	case "":
+		psn.hostnameMode = hostnameDrop
+	case hostnameDrop, hostnamePath, hostnameValue:
+		psn.hostnameMode = hostnameMode
+	default:
+		return fmt.Errorf("unsupported hostname mode %s", hostnameMode)
+	}
+
+	// select where ECN conditions come from
+	switch ecnConditions := md.Get("ecn_conditions", true); ecnConditions {
+	case "", "plugin":
+		psn.recomputeECN = false
+	case "recompute":
+		psn.recomputeECN = true
+	default:
+		return fmt.Errorf("unsupported ecn_conditions %s", ecnConditions)
+	}
+
+	// select plugins to synthesize not_seen conditions for
+	if psn.notSeenPlugins, err = parseNotSeenPlugins(md.Get("synthesize_not_seen", true)); err != nil {
+		return err
+	}
 
 	// create a scanning normalizer
 	sn := pto3.NewParallelScanningNormalizer(metadataURL, 4)
-	sn.RegisterFiletype("pathspider-v1-ecn-ndjson", bufio.ScanLines, normalizeV1, nil)
-	sn.RegisterFiletype("pathspider-v2-ndjson", bufio.ScanLines, normalizeV2, nil)
+
+	// register each filetype, with and without compression suffix
+	suffixes := []string{""}
+	for suffix := range ecn.CompressionSuffixes {
+		suffixes = append(suffixes, suffix)
+	}
+
+	for _, suffix := range suffixes {
+		sn.RegisterFiletype("pathspider-v1-ecn-ndjson"+suffix, ecn.ScanNumberedLines(), quality.Wrap(budget, psn.normalizeV1), ecn.MergeCounts)
+		sn.RegisterFiletype("pathspider-v2-ndjson"+suffix, ecn.ScanNumberedLines(), quality.Wrap(budget, psn.normalizeV2), ecn.MergeCounts)
+	}
+
+	// decompress if necessary
+	r, _, err := ecn.OpenInput(in, md.Filetype(true))
+	if err != nil {
+		return err
+	}
+
+	// hold output back if the error budget can only be checked at the end
+	sink := out
+	var spool *os.File
+	if budget.Deferred() {
+		if spool, err = ioutil.TempFile("", "normalize_pathspider"); err != nil {
+			return err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		sink = spool
+	}
 
 	// and run it
-	if err := sn.Normalize(os.Stdin, mdfile, os.Stdout); err != nil {
-		log.Fatal(err)
+	if err := sn.Normalize(r, bytes.NewReader(mdbytes), sink); err != nil {
+		return err
+	}
+
+	if err := budget.Check(); err != nil {
+		return err
+	}
+
+	if spool != nil {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, spool); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var rejectFlag = flag.String("reject", "", "write raw records skipped under the error policy to `file`")
+
+var validateFlag = flag.Bool("validate", false, "check metadata against raw data and report mismatches as JSON instead of normalizing")
+
+var normalizerFlags = ecn.NewNormalizerFlags()
+
+// descriptor describes this normalizer to the PTO
+func descriptor() *ecn.Descriptor {
+	return &ecn.Descriptor{
+		Owner:       ecn.DescriptorOwner,
+		Description: "A normalizer to extract observations from Pathspider version 1 (ECN plugin) and version 2 (ECN, TFO, DSCP, UDP options and EvilBit plugins) NDJSON files",
+		FileTypes:   ecn.CompressedFiletypes(ecn.FiletypePathspiderV1, ecn.FiletypePathspiderV2),
+		Conditions:  psConditions(),
+		Platform:    ecn.DescriptorPlatform,
+		Invocation:  "normalize_pathspider",
+	}
+}
+
+var descriptorFlags = ecn.NewDescriptorFlags()
+
+// run normalizes and returns the exit status. It must not exit itself, as
+// the output and reject files are only flushed by its deferred closes.
+func run() int {
+	// describe this normalizer instead of running if requested
+	if descriptorFlags.Requested() {
+		ok, err := descriptorFlags.Run(descriptor(), os.Stdout)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if !ok {
+			return 1
+		}
+		return 0
 	}
+
+	// open input, metadata and output streams
+	nio, err := normalizerFlags.Open()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer nio.Close()
+
+	// check metadata against content instead of normalizing if requested
+	if *validateFlag {
+		valid, err := ecn.ValidateInput(nio.In, nio.Meta, nio.Out, []string{ecn.FiletypePathspiderV1, ecn.FiletypePathspiderV2})
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		if !valid {
+			return 1
+		}
+		return 0
+	}
+
+	// open the reject file if requested
+	var reject io.Writer
+	if *rejectFlag != "" {
+		rejectfile, err := os.Create(*rejectFlag)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer rejectfile.Close()
+		reject = rejectfile
+	}
+
+	// and go
+	normalize := func(in io.Reader, metain io.Reader, out io.Writer) error {
+		return normalizePathspider(in, metain, out, reject)
+	}
+
+	if err := ecn.NormalizeInput(nio.In, nio.Meta, nio.Out, normalize); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	return 0
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	ecn "github.com/mami-project/pto3-ecn"
+)
+
+// psPlugin describes the conditions generated by a PathSpider v2 plugin, and
+// how they map to PTO conditions.
+type psPlugin struct {
+	// feature is the first component of every condition the plugin generates
+	feature string
+
+	// conditions declares every PTO condition the plugin may generate
+	conditions []string
+
+	// rewrite, if present, maps a plugin condition and value that do not fit
+	// the PTO condition namespace as-is to ones that do
+	rewrite func(cond string, value string) (string, string)
+
+	// notSeenAspects, if present, lists the aspects of mark conditions for
+	// which a not_seen condition is synthesized when a record contains none
+	// of the aspect's conditions
+	notSeenAspects []string
+
+	// capableConditions lists the conditions showing that a connection using
+	// the feature was made; not_seen conditions are only synthesized for
+	// records containing one of these
+	capableConditions []string
+}
+
+func connectivityConditions(feature string) []string {
+	return []string{
+		feature + ".connectivity.works",
+		feature + ".connectivity.broken",
+		feature + ".connectivity.transient",
+		feature + ".connectivity.offline",
+	}
+}
+
+// dscpMarkRegexp matches the per-codepoint conditions of the DSCP plugin
+var dscpMarkRegexp = regexp.MustCompile(`^dscp\.(\d+)\.replymark$`)
+
+// rewriteDSCP moves the codepoint out of DSCP reply mark condition names and
+// into the value, as codepoint:replymark, so that the condition is fixed.
+func rewriteDSCP(cond string, value string) (string, string) {
+	if m := dscpMarkRegexp.FindStringSubmatch(cond); m != nil {
+		return "dscp.replymark", m[1] + ":" + value
+	}
+	return cond, value
+}
+
+// psPlugins lists the PathSpider plugins in the order their conditions appear
+// in the descriptor.
+var psPlugins = []*psPlugin{
+	{
+		feature:    "ecn",
+		conditions: ecn.ECNPairConditions,
+		notSeenAspects: []string{
+			"ecn.ipmark.ect0",
+			"ecn.ipmark.ect1",
+			"ecn.ipmark.ce",
+		},
+		capableConditions: []string{
+			"ecn.connectivity.works",
+			"ecn.connectivity.transient",
+		},
+	},
+	{
+		feature: "tfo",
+		conditions: append(connectivityConditions("tfo"),
+			"tfo.cookie.received",
+			"tfo.cookie.not_received",
+			"tfo.syndata.acked",
+			"tfo.syndata.not_acked",
+			"tfo.syndata.failed"),
+	},
+	{
+		feature: "dscp",
+		conditions: append(connectivityConditions("dscp"),
+			"dscp.replymark"),
+		rewrite: rewriteDSCP,
+	},
+	{
+		feature: "udpopts",
+		conditions: append(connectivityConditions("udpopts"),
+			"udpopts.options.echoed",
+			"udpopts.options.not_echoed",
+			"udpopts.checksum.valid",
+			"udpopts.checksum.invalid"),
+	},
+	{
+		feature: "evilbit",
+		conditions: append(connectivityConditions("evilbit"),
+			"evilbit.mark.seen",
+			"evilbit.mark.not_seen"),
+		notSeenAspects: []string{
+			"evilbit.mark",
+		},
+		capableConditions: []string{
+			"evilbit.connectivity.works",
+			"evilbit.connectivity.transient",
+		},
+	},
+}
+
+// psConditions returns every condition the normalizer may generate, for the
+// descriptor.
+func psConditions() []string {
+	var out []string
+	for _, plugin := range psPlugins {
+		out = append(out, plugin.conditions...)
+	}
+	return append(out, ecn.FamilyConditions...)
+}
+
+// psPluginsByFeature maps the feature of a PathSpider condition to the plugin
+// that generates it
+var psPluginsByFeature = make(map[string]*psPlugin)
+
+// psPluginConditions is the set of all conditions declared by all plugins
+var psPluginConditions = make(map[string]struct{})
+
+func init() {
+	for _, plugin := range psPlugins {
+		psPluginsByFeature[plugin.feature] = plugin
+		for _, cond := range plugin.conditions {
+			psPluginConditions[cond] = struct{}{}
+		}
+	}
+}
+
+// mapPluginCondition maps a PathSpider v2 condition and value to a PTO
+// condition and value, and checks the result against the conditions declared
+// by the plugin that generated it. Conditions from unknown plugins are
+// returned unchanged, and are not declared.
+func mapPluginCondition(cond string, value string) (string, string, bool) {
+	feature := strings.SplitN(cond, ".", 2)[0]
+
+	plugin, ok := psPluginsByFeature[feature]
+	if !ok {
+		return cond, value, false
+	}
+
+	if plugin.rewrite != nil {
+		cond, value = plugin.rewrite(cond, value)
+	}
+
+	_, declared := psPluginConditions[cond]
+	return cond, value, declared
+}
+
+// defaultNotSeenPlugins lists the plugins not_seen conditions are
+// synthesized for if the synthesize_not_seen metadata key is not given
+const defaultNotSeenPlugins = "ecn"
+
+// parseNotSeenPlugins parses the value of the synthesize_not_seen metadata
+// key, a comma-separated list of plugins or none, into a set of plugins.
+func parseNotSeenPlugins(spec string) (map[string]struct{}, error) {
+	out := make(map[string]struct{})
+
+	if spec == "" {
+		spec = defaultNotSeenPlugins
+	}
+	if spec == "none" {
+		return out, nil
+	}
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		plugin, ok := psPluginsByFeature[name]
+		if !ok || len(plugin.notSeenAspects) == 0 {
+			return nil, fmt.Errorf("cannot synthesize not_seen conditions for plugin %s", name)
+		}
+		out[name] = struct{}{}
+	}
+
+	return out, nil
+}
+
+// synthesizeNotSeen returns the not_seen conditions to add to a record
+// containing the given conditions, for each of the given plugins for which
+// the record shows a capable connection, in plugin table order.
+func synthesizeNotSeen(conds map[string]struct{}, plugins map[string]struct{}) []string {
+	var out []string
+
+	for _, plugin := range psPlugins {
+		if _, ok := plugins[plugin.feature]; !ok {
+			continue
+		}
+
+		capable := false
+		for _, cond := range plugin.capableConditions {
+			if _, ok := conds[cond]; ok {
+				capable = true
+				break
+			}
+		}
+		if !capable {
+			continue
+		}
+
+		for _, aspect := range plugin.notSeenAspects {
+			_, seen := conds[aspect+".seen"]
+			_, notSeen := conds[aspect+".not_seen"]
+			if !seen && !notSeen {
+				out = append(out, aspect+".not_seen")
+			}
+		}
+	}
+
+	return out
+}
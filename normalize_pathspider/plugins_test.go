@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSynthesizeNotSeenOrder(t *testing.T) {
+	conds := map[string]struct{}{
+		"ecn.connectivity.works":     {},
+		"ecn.ipmark.ect1.seen":       {},
+		"evilbit.connectivity.works": {},
+	}
+	plugins, err := parseNotSeenPlugins("evilbit,ecn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"ecn.ipmark.ect0.not_seen",
+		"ecn.ipmark.ce.not_seen",
+		"evilbit.mark.not_seen",
+	}
+
+	// map iteration order varies, so a single pass could pass by chance
+	for i := 0; i < 20; i++ {
+		if got := synthesizeNotSeen(conds, plugins); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	ecn "github.com/mami-project/pto3-ecn"
+)
+
+// psV2Flow holds the observer fields of a single flow in the flow results of
+// a PathSpider v2 ECN record, as needed to recompute ECN conditions.
+type psV2Flow struct {
+	Connected   bool  `json:"tcp_connected"`
+	SynFlagsFwd *int  `json:"tcp_synflags_fwd"`
+	SynFlagsRev *int  `json:"tcp_synflags_rev"`
+	ECT0SynRev  bool  `json:"ecn_ect0_syn_rev"`
+	ECT1SynRev  bool  `json:"ecn_ect1_syn_rev"`
+	CESynRev    bool  `json:"ecn_ce_syn_rev"`
+	ECT0DataRev bool  `json:"ecn_ect0_data_rev"`
+	ECT1DataRev bool  `json:"ecn_ect1_data_rev"`
+	CEDataRev   bool  `json:"ecn_ce_data_rev"`
+	SpiderState *int  `json:"spdr_state"`
+	Observed    *bool `json:"observed"`
+}
+
+// ecnPairFromFlows builds an ECN pair from the flow results of a PathSpider
+// v2 ECN record: the first flow is made without ECN and the second with.
+func ecnPairFromFlows(flows []psV2Flow) (*ecn.ECNPair, error) {
+	if len(flows) != 2 {
+		return nil, fmt.Errorf("expected 2 flow results, got %d", len(flows))
+	}
+
+	plain, ecnflow := &flows[0], &flows[1]
+
+	if plain.SpiderState != nil && ecnflow.SpiderState != nil &&
+		(*plain.SpiderState != 0 || *ecnflow.SpiderState != 1) {
+		return nil, fmt.Errorf("unexpected spider states %d, %d", *plain.SpiderState, *ecnflow.SpiderState)
+	}
+
+	if ecnflow.Observed != nil && !*ecnflow.Observed {
+		return nil, fmt.Errorf("ECN flow not observed")
+	}
+
+	if ecnflow.SynFlagsFwd == nil {
+		return nil, fmt.Errorf("missing SYN flags on ECN flow")
+	}
+
+	pair := new(ecn.ECNPair)
+	pair.PlainEstablished = plain.Connected
+	pair.ECNEstablished = ecnflow.Connected
+
+	synECN := *ecnflow.SynFlagsFwd & (ecn.ECE | ecn.CWR)
+	pair.ECNSynMalformed = synECN != 0 && synECN != (ecn.ECE|ecn.CWR)
+
+	if ecnflow.SynFlagsRev != nil {
+		synAckECN := *ecnflow.SynFlagsRev & (ecn.ECE | ecn.CWR)
+		pair.Negotiated = synAckECN == ecn.ECE
+		pair.Reflected = synAckECN == (ecn.ECE | ecn.CWR)
+	}
+
+	pair.ECT0 = ecnflow.ECT0SynRev || ecnflow.ECT0DataRev
+	pair.ECT1 = ecnflow.ECT1SynRev || ecnflow.ECT1DataRev
+	pair.CE = ecnflow.CESynRev || ecnflow.CEDataRev
+
+	return pair, nil
+}
+
+// conditionAspect returns a condition name without its final component.
+func conditionAspect(cond string) string {
+	if i := strings.LastIndex(cond, "."); i >= 0 {
+		return cond[:i]
+	}
+	return cond
+}
+
+// recomputeECNConditions replaces the ECN conditions reported by PathSpider
+// with those derived from the record's flow results, and returns the number
+// of aspects for which PathSpider reported a different condition.
+func recomputeECNConditions(conds []string, values []string, flows []psV2Flow) ([]string, []string, int, error) {
+	pair, err := ecnPairFromFlows(flows)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// index reported ECN conditions by aspect, and drop them
+	reported := make(map[string]string)
+	var outConds, outValues []string
+	for i, cond := range conds {
+		if strings.HasPrefix(cond, "ecn.") {
+			reported[conditionAspect(cond)] = cond
+		} else {
+			outConds = append(outConds, cond)
+			outValues = append(outValues, values[i])
+		}
+	}
+
+	disagreements := 0
+	for _, cond := range pair.Conditions() {
+		aspect := conditionAspect(cond)
+		if rcond, ok := reported[aspect]; ok && rcond != cond {
+			disagreements++
+		}
+
+		outConds = append(outConds, cond)
+		outValues = append(outValues, "")
+	}
+
+	return outConds, outValues, disagreements, nil
+}
@@ -0,0 +1,709 @@
+package ecn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// QofObserver pairs ECN-setup and plain TCP flows to the same target and
+// destination port, and generates ECN observations for each pair. Flows are
+// passed to it as maps keyed by IPFIX information element name.
+type QofObserver struct {
+	out              io.Writer
+	sourceOverride   string
+	sourcePrepend    string
+	requiredDstPorts map[uint16]struct{}
+	emitPerformance  bool
+	quarantineSyn    bool
+
+	hasCondition map[string]struct{}
+
+	pendingTCPFlows map[string]*QofTCPFlow
+	pendingECNFlows map[string]*QofTCPFlow
+
+	sourceCounts          map[string]int
+	sourceRejectThreshold int
+
+	handledFlowCount int
+	ignoredFlowCount int
+
+	synClassCounts       [synClassCount]int
+	malformedPairCount   int
+	quarantinedFlowCount int
+
+	quality *QualityStats
+
+	trace          io.Writer
+	flowConditions []string
+}
+
+// Decisions made about each flow, as recorded in the trace
+const (
+	flowIgnored = "ignored"
+	flowPending = "pending"
+	flowMatched = "matched"
+)
+
+// flowTrace is a single record in the per-flow debug trace
+type flowTrace struct {
+	Fields     map[string]interface{} `json:"fields"`
+	Decision   string                 `json:"decision"`
+	Reason     string                 `json:"reason,omitempty"`
+	Detail     string                 `json:"detail,omitempty"`
+	Conditions []string               `json:"conditions,omitempty"`
+}
+
+// NewQofObserver creates a new observer writing observations to the given
+// stream, and configures it from raw metadata.
+func NewQofObserver(out io.Writer, md *pto3.RawMetadata) (*QofObserver, error) {
+	qobs := new(QofObserver)
+
+	qobs.out = out
+	qobs.hasCondition = make(map[string]struct{})
+	qobs.pendingTCPFlows = make(map[string]*QofTCPFlow)
+	qobs.pendingECNFlows = make(map[string]*QofTCPFlow)
+	qobs.sourceCounts = make(map[string]int)
+	qobs.quality = NewQualityStats()
+	qobs.sourceRejectThreshold = 100
+
+	// initialize from metadata
+	qobs.sourceOverride = md.Get("source_override", true)
+	qobs.sourcePrepend = md.Get("source_prepend", true)
+
+	var err error
+	qobs.requiredDstPorts, err = parsePortList(md.Get("dst_port", true))
+	if err != nil {
+		return nil, err
+	}
+	qobs.emitPerformance, _ = strconv.ParseBool(md.Get("emit_performance", true))
+
+	switch md.Get("malformed_syn", true) {
+	case "", "report":
+		qobs.quarantineSyn = false
+	case "quarantine":
+		qobs.quarantineSyn = true
+	default:
+		return nil, fmt.Errorf("unsupported malformed_syn handling %s", md.Get("malformed_syn", true))
+	}
+
+	return qobs, nil
+}
+
+// SetTrace enables the per-flow debug trace, written as NDJSON to the given stream.
+func (qobs *QofObserver) SetTrace(trace io.Writer) {
+	qobs.trace = trace
+}
+
+const (
+	FIN      = 0x01
+	SYN      = 0x02
+	RST      = 0x04
+	PSH      = 0x08
+	ACK      = 0x10
+	URG      = 0x20
+	ECE      = 0x40
+	CWR      = 0x80
+	QECT0    = 0x01
+	QECT1    = 0x02
+	QCE      = 0x04
+	QTSOPT   = 0x10
+	QSACKOPT = 0x20
+	QWSOPT   = 0x40
+	QSYNECT0 = 0x0100
+	QSYNECT1 = 0x0200
+	QSYNCE   = 0x0400
+)
+
+// SYN classes, determined from the flags on the initial and last SYN of a flow
+const (
+	synPlain = iota
+	synECNSetup
+	synECNFallback
+	synMalformed
+	synClassCount
+)
+
+var synClassNames = [synClassCount]string{"plain", "ecn_setup", "ecn_fallback", "malformed"}
+
+// classifySyn determines the SYN class of a flow. A flow is an ECN setup if
+// its last SYN carried both ECE and CWR, and an ECN fallback if its initial
+// SYN did but a retransmitted SYN carried neither. SYNs carrying only one of
+// ECE and CWR are malformed.
+func classifySyn(initialFlags, lastSynFlags uint8) int {
+	initialECN := initialFlags & (ECE | CWR)
+	lastECN := lastSynFlags & (ECE | CWR)
+
+	switch {
+	case lastECN == (ECE | CWR):
+		return synECNSetup
+	case lastECN != 0:
+		return synMalformed
+	case initialECN == (ECE | CWR):
+		return synECNFallback
+	case initialECN != 0:
+		return synMalformed
+	default:
+		return synPlain
+	}
+}
+
+// QofTCPFlow is a TCP flow as seen by QoF (or reconstructed from packets),
+// reduced to the characteristics needed to generate ECN conditions.
+type QofTCPFlow struct {
+	startTime     time.Time
+	srcAddr       netip.Addr
+	dstAddr       netip.Addr
+	srcPort       uint16
+	dstPort       uint16
+	fwdLastSyn    uint8
+	revLastSyn    uint8
+	revQofChars   uint32
+	synClass      int
+	didEstablish  bool
+	ecnNegotiated bool
+	ecnReflected  bool
+	ecnECT0       bool
+	ecnECT1       bool
+	ecnCE         bool
+	packets       uint64
+	minRtt        uint32
+	declaredMss   uint16
+	observedMss   uint16
+	retransmits   uint64
+	lossEvents    uint64
+
+	// whether the optional counters were present in the flow record
+	hasRetransmits bool
+	hasLossEvents  bool
+}
+
+// parsePortList parses a comma-separated list of destination ports from
+// metadata. An empty list or the string "any" matches any port, and is
+// returned as an empty set.
+func parsePortList(portlist string) (map[uint16]struct{}, error) {
+	out := make(map[uint16]struct{})
+
+	portlist = strings.TrimSpace(portlist)
+	if portlist == "" || portlist == "any" {
+		return out, nil
+	}
+
+	for _, portstr := range strings.Split(portlist, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(portstr), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("bad destination port %s", portstr)
+		}
+		out[uint16(port)] = struct{}{}
+	}
+
+	return out, nil
+}
+
+func flowFromMap(fmap map[string]interface{}, requireSyn bool, requireDports map[uint16]struct{}) (*QofTCPFlow, error) {
+
+	// drop flows without syn
+	fif, hasInitialFlags := fmap["initialTCPFlags"]
+	if requireSyn {
+		if !hasInitialFlags {
+			return nil, NewRecordError("missing_field", fmt.Errorf("missing initial flags"))
+		}
+
+		if fif.(uint8)&SYN == 0 {
+			return nil, NewRecordError("no_syn", fmt.Errorf("no syn"))
+		}
+	}
+
+	// drop flows without required port
+	dp, ok := fmap["destinationTransportPort"]
+	if !ok {
+		return nil, NewRecordError("missing_field", fmt.Errorf("missing destination port"))
+	}
+
+	if len(requireDports) > 0 {
+		if _, ok := requireDports[dp.(uint16)]; !ok {
+			return nil, NewRecordError("other_port", fmt.Errorf("bad destination port"))
+		}
+	}
+
+	// get the rest of the required keys from the map
+	stime, ok := fmap["flowStartMilliseconds"]
+	if !ok {
+		return nil, NewRecordError("missing_field", fmt.Errorf("missing start time"))
+	}
+
+	sa, ok := fmap["sourceIPv4Address"]
+	if !ok {
+		sa, ok = fmap["sourceIPv6Address"]
+		if !ok {
+			return nil, NewRecordError("missing_field", fmt.Errorf("missing source IP address"))
+		}
+	}
+
+	da, ok := fmap["destinationIPv4Address"]
+	if !ok {
+		da, ok = fmap["destinationIPv6Address"]
+		if !ok {
+			return nil, NewRecordError("missing_field", fmt.Errorf("missing destination IP address"))
+		}
+	}
+
+	sp, ok := fmap["sourceTransportPort"]
+	if !ok {
+		return nil, NewRecordError("missing_field", fmt.Errorf("missing source port"))
+	}
+
+	fls, ok := fmap["lastSynTcpFlags"]
+	if !ok {
+		return nil, NewRecordError("missing_field", fmt.Errorf("missing forward syn flags"))
+	}
+
+	rls, ok := fmap["reverseLastSynTcpFlags"]
+	if !ok {
+		return nil, NewRecordError("missing_field", fmt.Errorf("missing reverse syn flags"))
+	}
+
+	rqc, ok := fmap["reverseQofTcpCharacteristics"]
+	if !ok {
+		return nil, NewRecordError("missing_field", fmt.Errorf("missing magic qof stuff"))
+	}
+
+	// make a new flow
+	out := new(QofTCPFlow)
+
+	// extract time, addresses and ports
+	out.startTime = stime.(time.Time).UTC()
+	var err error
+	if out.srcAddr, err = CanonicalIP(*sa.(*net.IP)); err != nil {
+		return nil, NewRecordError("bad_address", fmt.Errorf("bad source address: %s", err.Error()))
+	}
+	if out.dstAddr, err = CanonicalIP(*da.(*net.IP)); err != nil {
+		return nil, NewRecordError("bad_address", fmt.Errorf("bad destination address: %s", err.Error()))
+	}
+	out.srcPort = sp.(uint16)
+	out.dstPort = dp.(uint16)
+
+	// extract TCP flags
+	out.fwdLastSyn = fls.(uint8)
+	out.revLastSyn = rls.(uint8)
+	out.revQofChars = rqc.(uint32)
+
+	// classify the SYN, falling back to the last SYN if the initial flags are missing
+	if hasInitialFlags {
+		out.synClass = classifySyn(fif.(uint8), out.fwdLastSyn)
+	} else {
+		out.synClass = classifySyn(out.fwdLastSyn, out.fwdLastSyn)
+	}
+
+	// calculate characteristics
+	out.ecnNegotiated = out.revLastSyn&(SYN|ACK|ECE|CWR) == (SYN | ACK | ECE)
+	out.ecnReflected = out.revLastSyn&(SYN|ACK|ECE|CWR) == (SYN | ACK | ECE | CWR)
+	out.ecnECT0 = out.revQofChars&QECT0 == QECT0
+	out.ecnECT1 = out.revQofChars&QECT1 == QECT1
+	out.ecnCE = out.revQofChars&QCE == QCE
+	out.didEstablish = (out.fwdLastSyn&(SYN|ACK|FIN|RST) == (SYN) &&
+		out.revLastSyn&(SYN|ACK|FIN|RST) == (SYN|ACK))
+
+	// extract performance counters where present; these are optional
+	if v, ok := fmap["packetDeltaCount"].(uint64); ok {
+		out.packets = v
+	}
+	if v, ok := fmap["minTcpRttMilliseconds"].(uint32); ok {
+		out.minRtt = v
+	}
+	if v, ok := fmap["declaredTcpMss"].(uint16); ok {
+		out.declaredMss = v
+	}
+	if v, ok := fmap["observedTcpMss"].(uint16); ok {
+		out.observedMss = v
+	}
+	if v, ok := fmap["tcpRetransmitCount"].(uint64); ok {
+		out.retransmits = v
+		out.hasRetransmits = true
+	}
+	if v, ok := fmap["tcpLossEventCount"].(uint64); ok {
+		out.lossEvents = v
+		out.hasLossEvents = true
+	}
+
+	return out, nil
+}
+
+func (qobs *QofObserver) pathFor(pathflow *QofTCPFlow) *pto3.Path {
+
+	// make a path
+	path := new(pto3.Path)
+
+	// handle source override from metadata
+	var source string
+	if qobs.sourceOverride != "" {
+		source = qobs.sourceOverride
+	} else {
+		source = pathflow.srcAddr.String()
+	}
+
+	// handle source prepend from metadata
+	var pathElements []string
+	if qobs.sourcePrepend != "" {
+		if source != "" {
+			pathElements = []string{qobs.sourcePrepend, source, "*", pathflow.dstAddr.String()}
+		} else {
+			pathElements = []string{qobs.sourcePrepend, "*", pathflow.dstAddr.String()}
+		}
+	} else {
+		if source != "" {
+			pathElements = []string{source, "*", pathflow.dstAddr.String()}
+		} else {
+			pathElements = []string{"*", pathflow.dstAddr.String()}
+		}
+	}
+
+	path.String = strings.Join(pathElements, " ")
+
+	return path
+}
+
+func (qobs *QofObserver) observe(pathflow *QofTCPFlow, conditions ...string) error {
+
+	path := qobs.pathFor(pathflow)
+
+	// record the destination port as the value of each condition
+	port := portValue(pathflow, "")
+
+	obsen := make([]pto3.Observation, len(conditions))
+	for i, c := range conditions {
+		obsen[i].TimeStart = &pathflow.startTime
+		obsen[i].TimeEnd = &pathflow.startTime
+		obsen[i].Path = path
+		obsen[i].Condition = new(pto3.Condition)
+		obsen[i].Condition.Name = c
+		obsen[i].Value = port
+
+		qobs.hasCondition[c] = struct{}{}
+		qobs.flowConditions = append(qobs.flowConditions, c)
+	}
+
+	qobs.quality.Observe(obsen)
+	return pto3.WriteObservations(obsen, qobs.out)
+}
+
+// portValue encodes the value of an observation of a flow: the destination
+// port of the flow, followed by a colon and the measurement, if any, so that
+// measurements on different ports to the same target can be told apart.
+func portValue(pathflow *QofTCPFlow, measurement string) string {
+	port := strconv.FormatUint(uint64(pathflow.dstPort), 10)
+	if measurement == "" {
+		return port
+	}
+	return port + ":" + measurement
+}
+
+func (qobs *QofObserver) observeValue(pathflow *QofTCPFlow, condition string, measurement string) error {
+
+	obsen := make([]pto3.Observation, 1)
+	obsen[0].TimeStart = &pathflow.startTime
+	obsen[0].TimeEnd = &pathflow.startTime
+	obsen[0].Path = qobs.pathFor(pathflow)
+	obsen[0].Condition = new(pto3.Condition)
+	obsen[0].Condition.Name = condition
+	obsen[0].Value = portValue(pathflow, measurement)
+
+	qobs.hasCondition[condition] = struct{}{}
+	qobs.flowConditions = append(qobs.flowConditions, condition)
+
+	qobs.quality.Observe(obsen)
+	return pto3.WriteObservations(obsen, qobs.out)
+}
+
+// QofPerformanceConditions lists the conditions generated with
+// emit_performance, in addition to those for each pair of flows.
+var QofPerformanceConditions = []string{
+	"tcp.rtt.min.ecn",
+	"tcp.rtt.min.plain",
+	"tcp.retransmit.rate.ecn",
+	"tcp.retransmit.rate.plain",
+	"tcp.loss.events.ecn",
+	"tcp.loss.events.plain",
+	"tcp.mss.clamped",
+	"tcp.mss.not_clamped",
+}
+
+// QofPairConditions returns the conditions a QofObserver generates for each
+// pair of flows.
+func QofPairConditions() []string {
+	var out []string
+	out = append(out, ECNPairConditions...)
+	out = append(out, ECNFallbackCondition)
+	out = append(out, FamilyConditions...)
+	return out
+}
+
+// QofConditions returns every condition a QofObserver may generate from
+// QoF flow records, which carry the performance counters.
+func QofConditions() []string {
+	return append(QofPairConditions(), QofPerformanceConditions...)
+}
+
+// observePerformance generates RTT, retransmission and loss observations for
+// a single flow of a matched pair. The state of each condition (ecn or plain)
+// identifies which flow of the pair the value was measured on.
+func (qobs *QofObserver) observePerformance(pathflow *QofTCPFlow, state string) error {
+
+	if pathflow.minRtt > 0 {
+		if err := qobs.observeValue(pathflow, "tcp.rtt.min."+state,
+			strconv.FormatUint(uint64(pathflow.minRtt), 10)); err != nil {
+			return err
+		}
+	}
+
+	// only report counters the flow record actually had
+	if pathflow.packets > 0 && pathflow.hasRetransmits {
+		rate := float64(pathflow.retransmits) / float64(pathflow.packets)
+		if err := qobs.observeValue(pathflow, "tcp.retransmit.rate."+state,
+			strconv.FormatFloat(rate, 'f', 4, 64)); err != nil {
+			return err
+		}
+	}
+
+	if pathflow.hasLossEvents {
+		if err := qobs.observeValue(pathflow, "tcp.loss.events."+state,
+			strconv.FormatUint(pathflow.lossEvents, 10)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// observeMSS generates an MSS clamping observation for a path. The MSS
+// observed on the wire is compared to the one we declared; a smaller observed
+// MSS indicates that something on the path rewrote the option.
+func (qobs *QofObserver) observeMSS(pathflow *QofTCPFlow) error {
+
+	if pathflow.declaredMss == 0 || pathflow.observedMss == 0 {
+		return nil
+	}
+
+	var mssCondition string
+	if pathflow.observedMss < pathflow.declaredMss {
+		mssCondition = "tcp.mss.clamped"
+	} else {
+		mssCondition = "tcp.mss.not_clamped"
+	}
+
+	return qobs.observeValue(pathflow, mssCondition,
+		strconv.FormatUint(uint64(pathflow.observedMss), 10))
+}
+
+func (qobs *QofObserver) matchFlows(flowkey string, tcpflow, ecnflow *QofTCPFlow) error {
+
+	// generate connectivity, negotiation and mark conditions; pairFlow only
+	// ever pends plain flows as tcpflow
+	pair := ECNPair{
+		PlainEstablished: tcpflow.didEstablish,
+		ECNEstablished:   ecnflow.didEstablish,
+		ECNSynMalformed:  ecnflow.synClass == synMalformed,
+		ECNFallback:      ecnflow.synClass == synECNFallback,
+		Negotiated:       ecnflow.ecnNegotiated,
+		Reflected:        ecnflow.ecnReflected,
+		ECT0:             ecnflow.ecnECT0,
+		ECT1:             ecnflow.ecnECT1,
+		CE:               ecnflow.ecnCE,
+	}
+
+	if pair.ECNSynMalformed {
+		qobs.malformedPairCount++
+	}
+
+	conditions := append(pair.Conditions(), FamilyCondition(ecnflow.dstAddr))
+	if err := qobs.observe(ecnflow, conditions...); err != nil {
+		return err
+	}
+
+	// generate performance conditions for both flows if requested
+	if qobs.emitPerformance {
+		if err := qobs.observePerformance(ecnflow, "ecn"); err != nil {
+			return err
+		}
+
+		if err := qobs.observePerformance(tcpflow, "plain"); err != nil {
+			return err
+		}
+
+		if err := qobs.observeMSS(tcpflow); err != nil {
+			return err
+		}
+	}
+
+	// match is no longer pending
+	delete(qobs.pendingECNFlows, flowkey)
+	delete(qobs.pendingTCPFlows, flowkey)
+
+	return nil
+}
+
+// pairFlow turns a map into a flow and pairs it with a pending flow to the
+// same target and port if possible. It returns the decision made about the
+// flow, and if the flow was ignored, a fixed identifier for the reason and a
+// description of the problem with the flow.
+func (qobs *QofObserver) pairFlow(fmap map[string]interface{}) (string, string, string, error) {
+
+	// turn the map into a flow, skip flows we don't care about
+	flow, err := flowFromMap(fmap, true, qobs.requiredDstPorts)
+	if err != nil {
+		qobs.ignoredFlowCount++
+		if recerr, ok := err.(*RecordError); ok {
+			return flowIgnored, recerr.Reason, recerr.Err.Error(), nil
+		}
+		return flowIgnored, "other", err.Error(), nil
+	}
+
+	// extract addresses, reject reversed flows
+	source := flow.srcAddr.String()
+	qobs.sourceCounts[source]++
+
+	target := flow.dstAddr.String()
+
+	if qobs.handledFlowCount > qobs.sourceRejectThreshold &&
+		qobs.sourceCounts[target] > qobs.sourceRejectThreshold/2 {
+		qobs.ignoredFlowCount++
+		return flowIgnored, "reversed_flow", "", nil
+	}
+
+	qobs.handledFlowCount++
+	qobs.synClassCounts[flow.synClass]++
+
+	// quarantine malformed SYNs if requested
+	if flow.synClass == synMalformed && qobs.quarantineSyn {
+		qobs.quarantinedFlowCount++
+		return flowIgnored, "quarantined_syn", "", nil
+	}
+
+	// pair flows per target and destination port
+	flowkey := fmt.Sprintf("%s %d", target, flow.dstPort)
+
+	// determine whether the flow is an ECN attempt (or a malformed one) or not
+	if flow.synClass != synPlain {
+		ecnflow := flow
+		if tcpflow, ok := qobs.pendingTCPFlows[flowkey]; ok {
+			return flowMatched, "", "", qobs.matchFlows(flowkey, tcpflow, ecnflow)
+		} else {
+			qobs.pendingECNFlows[flowkey] = ecnflow
+		}
+	} else {
+		tcpflow := flow
+		if ecnflow, ok := qobs.pendingECNFlows[flowkey]; ok {
+			return flowMatched, "", "", qobs.matchFlows(flowkey, tcpflow, ecnflow)
+		} else {
+			qobs.pendingTCPFlows[flowkey] = tcpflow
+		}
+	}
+
+	return flowPending, "", "", nil
+}
+
+// HandleFlow handles a single flow given as a map keyed by IPFIX information
+// element name. Flows that cannot be used are counted and ignored; an error is
+// returned only if writing observations or trace records fails.
+func (qobs *QofObserver) HandleFlow(fmap map[string]interface{}) error {
+
+	qobs.flowConditions = qobs.flowConditions[:0]
+
+	decision, reason, detail, err := qobs.pairFlow(fmap)
+	if err != nil {
+		return err
+	}
+
+	qobs.quality.Record()
+	if decision == flowIgnored {
+		qobs.quality.Skip(reason)
+	}
+
+	// write a trace record for the flow if requested
+	if qobs.trace != nil {
+		b, err := json.Marshal(flowTrace{
+			Fields:     fmap,
+			Decision:   decision,
+			Reason:     reason,
+			Detail:     detail,
+			Conditions: qobs.flowConditions,
+		})
+		if err != nil {
+			return fmt.Errorf("error marshaling flow trace: %s", err.Error())
+		}
+
+		if _, err := fmt.Fprintf(qobs.trace, "%s\n", b); err != nil {
+			return fmt.Errorf("error writing flow trace: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// HandledFlowCount returns the number of flows handled so far.
+func (qobs *QofObserver) HandledFlowCount() int {
+	return qobs.handledFlowCount
+}
+
+// LogStatus logs flow counts and the number of flows still pending a match.
+func (qobs *QofObserver) LogStatus() {
+	log.Printf("ignored %d handled %d pending TCP %d pending ECN %d\n",
+		qobs.ignoredFlowCount,
+		qobs.handledFlowCount,
+		len(qobs.pendingTCPFlows),
+		len(qobs.pendingECNFlows))
+}
+
+// WriteMetadata writes output metadata for the observations generated so far,
+// derived from the given raw metadata, to the output stream.
+func (qobs *QofObserver) WriteMetadata(md *pto3.RawMetadata, analyzerURL string) error {
+	mdout := make(map[string]interface{})
+	mdcond := make([]string, 0)
+
+	// copy all aux metadata from the raw file
+	for k := range md.Metadata {
+		mdout[k] = md.Metadata[k]
+	}
+
+	// create condition list from observed conditions
+	for k := range qobs.hasCondition {
+		mdcond = append(mdcond, k)
+	}
+	mdout["_conditions"] = mdcond
+
+	// add SYN classification counts
+	for i, name := range synClassNames {
+		mdout["syn_count_"+name] = qobs.synClassCounts[i]
+	}
+	mdout["malformed_pair_count"] = qobs.malformedPairCount
+	mdout["quarantined_flow_count"] = qobs.quarantinedFlowCount
+
+	// add quality statistics; ignored flows are counted as skipped records
+	mdout["quality"] = qobs.quality
+
+	// add start and end time and owner, since we have it
+	mdout["_owner"] = md.Owner(true)
+	mdout["_time_start"] = md.TimeStart(true).UTC().Format(time.RFC3339)
+	mdout["_time_end"] = md.TimeEnd(true).UTC().Format(time.RFC3339)
+	mdout["_analyzer"] = analyzerURL
+
+	// serialize and write to stdout
+	b, err := json.Marshal(mdout)
+	if err != nil {
+		return fmt.Errorf("error marshaling metadata: %s", err.Error())
+	}
+
+	if _, err := fmt.Fprintf(qobs.out, "%s\n", b); err != nil {
+		return fmt.Errorf("error writing metadata: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package ecn
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testQofFlowMap returns the fields of an ECN setup flow record, as read
+// from QoF IPFIX, with the given reverse QoF TCP characteristics.
+func testQofFlowMap(revQofChars uint32) map[string]interface{} {
+	sip := net.ParseIP("192.0.2.1")
+	dip := net.ParseIP("198.51.100.1")
+
+	return map[string]interface{}{
+		"initialTCPFlags":              uint8(SYN | ECE | CWR),
+		"lastSynTcpFlags":              uint8(SYN | ECE | CWR),
+		"reverseLastSynTcpFlags":       uint8(SYN | ACK | ECE),
+		"destinationTransportPort":     uint16(80),
+		"sourceTransportPort":          uint16(49152),
+		"flowStartMilliseconds":        time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC),
+		"sourceIPv4Address":            &sip,
+		"destinationIPv4Address":       &dip,
+		"reverseQofTcpCharacteristics": revQofChars,
+	}
+}
+
+func TestQofFlowMarks(t *testing.T) {
+	tests := []struct {
+		revQofChars uint32
+		ect0        bool
+		ect1        bool
+		ce          bool
+	}{
+		{0, false, false, false},
+		{QECT0, true, false, false},
+		{QECT1, false, true, false},
+		{QCE, false, false, true},
+		{QECT0 | QECT1, true, true, false},
+		{QECT0 | QECT1 | QCE, true, true, true},
+	}
+
+	for _, test := range tests {
+		flow, err := flowFromMap(testQofFlowMap(test.revQofChars), true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if flow.ecnECT0 != test.ect0 || flow.ecnECT1 != test.ect1 || flow.ecnCE != test.ce {
+			t.Errorf("characteristics %#x: got ect0 %v ect1 %v ce %v, want ect0 %v ect1 %v ce %v",
+				test.revQofChars, flow.ecnECT0, flow.ecnECT1, flow.ecnCE, test.ect0, test.ect1, test.ce)
+		}
+	}
+}
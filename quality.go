@@ -0,0 +1,187 @@
+package ecn
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// QualityStats collects data quality statistics for a single normalizer run:
+// how many raw records were read and skipped, how many observations were
+// emitted for each condition, how many distinct sources and targets they
+// cover, and the time range actually observed. It is safe for concurrent use,
+// and marshals to the quality block in output metadata.
+type QualityStats struct {
+	lock sync.Mutex
+
+	recordCount     int
+	skippedCount    map[string]int
+	conditionCount  map[string]int
+	sources         map[string]struct{}
+	targets         map[string]struct{}
+	timeStart       *time.Time
+	timeEnd         *time.Time
+	observationSeen bool
+}
+
+// NewQualityStats creates a new, empty set of quality statistics.
+func NewQualityStats() *QualityStats {
+	qs := new(QualityStats)
+	qs.skippedCount = make(map[string]int)
+	qs.conditionCount = make(map[string]int)
+	qs.sources = make(map[string]struct{})
+	qs.targets = make(map[string]struct{})
+	return qs
+}
+
+// Record counts a raw record read.
+func (qs *QualityStats) Record() {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	qs.recordCount++
+}
+
+// Skip counts a raw record skipped for the given reason.
+func (qs *QualityStats) Skip(reason string) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	qs.skippedCount[reason]++
+}
+
+// ErrNotRecord is returned by a scanning normalizer function wrapped with
+// QualityStats.Wrap for a line that is not a record at all, such as junk
+// between records, so that it is neither counted nor treated as malformed.
+var ErrNotRecord = errors.New("not a record")
+
+// pathEnds returns the first and last address in a path string, in canonical
+// form, as source and target. Other elements, such as wildcards, vantage
+// points prepended with source_prepend, AS numbers and hostnames, are not
+// counted; a path with a single address only has a target.
+func pathEnds(path string) (string, string) {
+	var addrs []string
+	for _, element := range strings.Fields(path) {
+		if addr, err := CanonicalAddress(element); err == nil {
+			addrs = append(addrs, addr.String())
+		}
+	}
+
+	switch len(addrs) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", addrs[0]
+	default:
+		return addrs[0], addrs[len(addrs)-1]
+	}
+}
+
+// Observe counts observations emitted.
+func (qs *QualityStats) Observe(obsen []pto3.Observation) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	for i := range obsen {
+		o := &obsen[i]
+
+		qs.conditionCount[o.Condition.Name]++
+
+		source, target := pathEnds(o.Path.String)
+		if source != "" {
+			qs.sources[source] = struct{}{}
+		}
+		if target != "" {
+			qs.targets[target] = struct{}{}
+		}
+
+		if o.TimeStart != nil && (qs.timeStart == nil || o.TimeStart.Before(*qs.timeStart)) {
+			qs.timeStart = o.TimeStart
+		}
+		if o.TimeEnd != nil && (qs.timeEnd == nil || o.TimeEnd.After(*qs.timeEnd)) {
+			qs.timeEnd = o.TimeEnd
+		}
+	}
+}
+
+// MarshalJSON marshals the statistics as a quality block.
+func (qs *QualityStats) MarshalJSON() ([]byte, error) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	skippedTotal := 0
+	for _, n := range qs.skippedCount {
+		skippedTotal += n
+	}
+
+	out := map[string]interface{}{
+		"records_read":      qs.recordCount,
+		"records_skipped":   skippedTotal,
+		"skipped_by_reason": qs.skippedCount,
+		"observations":      qs.conditionCount,
+		"distinct_sources":  len(qs.sources),
+		"distinct_targets":  len(qs.targets),
+	}
+
+	if qs.timeStart != nil {
+		out["time_start"] = qs.timeStart.UTC().Format(time.RFC3339)
+	}
+	if qs.timeEnd != nil {
+		out["time_end"] = qs.timeEnd.UTC().Format(time.RFC3339)
+	}
+
+	return json.Marshal(out)
+}
+
+// Wrap wraps a scanning normalizer function, counting each record and the
+// observations generated from it, and skipping malformed records as the error
+// budget allows. Blank lines, and lines for which the normalizer function
+// returns ErrNotRecord, are not counted. Line numbers added by
+// ScanNumberedLines are removed from records, and given in errors. The statistics themselves are passed to the normalizer's
+// metadata merge function once, as the value of the quality key; since they
+// are only marshaled when the normalizer writes its metadata, the block
+// reflects all records.
+func (qs *QualityStats) Wrap(eb *ErrorBudget, normFunc func([]byte, *pto3.RawMetadata, chan<- map[string]interface{}) ([]pto3.Observation, error)) func([]byte, *pto3.RawMetadata, chan<- map[string]interface{}) ([]pto3.Observation, error) {
+	var once sync.Once
+
+	return func(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]interface{}) ([]pto3.Observation, error) {
+		once.Do(func() {
+			mdout <- map[string]interface{}{"quality": qs}
+		})
+
+		lineno, rec := splitLineNumber(rec)
+		if len(bytes.TrimSpace(rec)) == 0 {
+			return nil, nil
+		}
+
+		obsen, err := normFunc(rec, mdin, mdout)
+		if err == ErrNotRecord {
+			return nil, nil
+		}
+
+		qs.Record()
+		eb.Record()
+
+		if err != nil {
+			reason, err := eb.Skip(rec, err)
+			if err != nil {
+				if lineno > 0 {
+					return nil, fmt.Errorf("error at line %d: %s", lineno, err.Error())
+				}
+				return nil, err
+			}
+
+			qs.Skip(reason)
+			return nil, nil
+		}
+
+		qs.Observe(obsen)
+		return obsen, nil
+	}
+}
@@ -0,0 +1,92 @@
+package ecn
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestPathEnds(t *testing.T) {
+	tests := []struct {
+		path   string
+		source string
+		target string
+	}{
+		{"192.0.2.1 * 198.51.100.1", "192.0.2.1", "198.51.100.1"},
+		{"vantage-zrh 192.0.2.1 * 198.51.100.1", "192.0.2.1", "198.51.100.1"},
+		{"192.0.2.1 * AS64496 198.51.100.1", "192.0.2.1", "198.51.100.1"},
+		{"192.0.2.1 * 2001:db8::1 www.example.com", "192.0.2.1", "2001:db8::1"},
+		{"* 198.51.100.1", "", "198.51.100.1"},
+		{"vantage-zrh * 198.51.100.1", "", "198.51.100.1"},
+		{"* www.example.com", "", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		source, target := pathEnds(test.path)
+		if source != test.source || target != test.target {
+			t.Errorf("%q: got %q, %q, want %q, %q", test.path, source, target, test.source, test.target)
+		}
+	}
+}
+
+func TestQualityStatsWrap(t *testing.T) {
+	eb, err := NewErrorBudget(testMetadata(t, `{"error_policy": "skip"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qs := NewQualityStats()
+
+	// records are paths; # marks junk, ! malformed records
+	normalize := func(rec []byte, mdin *pto3.RawMetadata, mdout chan<- map[string]interface{}) ([]pto3.Observation, error) {
+		switch rec[0] {
+		case '#':
+			return nil, ErrNotRecord
+		case '!':
+			return nil, NewRecordError("json", errors.New("bad"))
+		}
+		obs := pto3.Observation{Path: &pto3.Path{String: string(rec)}, Condition: &pto3.Condition{Name: "ecn.connectivity.works"}}
+		return []pto3.Observation{obs}, nil
+	}
+
+	wrapped := qs.Wrap(eb, normalize)
+	mdout := make(chan map[string]interface{}, 1)
+
+	for _, rec := range []string{
+		"1\tvantage-a 192.0.2.1 * 198.51.100.1",
+		"2\tvantage-a 192.0.2.2 * 198.51.100.1",
+		"",
+		"4\t   ",
+		"5\t# junk",
+		"6\t!",
+		"7\tvantage-a 192.0.2.2 * 198.51.100.2",
+	} {
+		if _, err := wrapped([]byte(rec), nil, mdout); err != nil {
+			t.Fatalf("%q: %s", rec, err.Error())
+		}
+	}
+
+	b, err := json.Marshal(qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]float64{
+		"records_read":     4,
+		"records_skipped":  1,
+		"distinct_sources": 2,
+		"distinct_targets": 2,
+	} {
+		if got[k] != want {
+			t.Errorf("%s: got %v, want %v", k, got[k], want)
+		}
+	}
+}
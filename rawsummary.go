@@ -0,0 +1,466 @@
+package ecn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/ipfix"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// Base filetypes handled by the normalizers
+const (
+	FiletypePathspiderV1 = "pathspider-v1-ecn-ndjson"
+	FiletypePathspiderV2 = "pathspider-v2-ndjson"
+	FiletypeQoF          = "ecnspider-qof-ipfix"
+	FiletypePcap         = "ecn-pcap"
+	FiletypePcapng       = "ecn-pcapng"
+)
+
+var pcapMagics = [][]byte{
+	{0xa1, 0xb2, 0xc3, 0xd4},
+	{0xd4, 0xc3, 0xb2, 0xa1},
+	{0xa1, 0xb2, 0x3c, 0x4d},
+	{0x4d, 0x3c, 0xb2, 0xa1},
+}
+
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+var ipfixVersion = []byte{0x00, 0x0a}
+
+// sniffBufferSize is the amount of decompressed data looked at to determine
+// the filetype; the first NDJSON record must fit within it.
+const sniffBufferSize = 1 << 20
+
+// sourceShareThreshold is the share of records a source address must account
+// for to be listed in metadata; this keeps reverse flows and the like out.
+const sourceShareThreshold = 0.01
+
+// sourceStats counts records from a single source address, and the
+// destination ports they were sent to.
+type sourceStats struct {
+	count int
+	ports map[int]struct{}
+}
+
+// RawSummary describes the content of a raw data file, as inferred by reading
+// it: its filetype, the time range and number of records, and the source
+// addresses and destination ports seen.
+type RawSummary struct {
+	Basetype       string
+	Codec          string
+	TimeStart      time.Time
+	TimeEnd        time.Time
+	RecordCount    int
+	MalformedCount int
+
+	sources map[string]*sourceStats
+}
+
+func newRawSummary() *RawSummary {
+	rs := new(RawSummary)
+	rs.sources = make(map[string]*sourceStats)
+	return rs
+}
+
+func (rs *RawSummary) addTime(start time.Time, end time.Time) {
+	if rs.TimeStart.IsZero() || start.Before(rs.TimeStart) {
+		rs.TimeStart = start
+	}
+	if end.After(rs.TimeEnd) {
+		rs.TimeEnd = end
+	}
+}
+
+// addSource counts a record from a source address to a destination port;
+// a negative port is not counted.
+func (rs *RawSummary) addSource(source string, port int) {
+	addr, err := CanonicalAddress(source)
+	if err != nil {
+		return
+	}
+	source = addr.String()
+
+	ss, ok := rs.sources[source]
+	if !ok {
+		ss = &sourceStats{ports: make(map[int]struct{})}
+		rs.sources[source] = ss
+	}
+
+	ss.count++
+	if port >= 0 {
+		ss.ports[port] = struct{}{}
+	}
+}
+
+// Filetype returns the filetype of the file, with compression suffix.
+func (rs *RawSummary) Filetype() string {
+	return rs.Basetype + CodecSuffix(rs.Codec)
+}
+
+// SourceAddresses returns the source addresses accounting for at least 1% of
+// records, most common first.
+func (rs *RawSummary) SourceAddresses() []string {
+	total := 0
+	sources := make([]string, 0)
+	for source, ss := range rs.sources {
+		total += ss.count
+		sources = append(sources, source)
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		ci, cj := rs.sources[sources[i]].count, rs.sources[sources[j]].count
+		if ci != cj {
+			return ci > cj
+		}
+		return sources[i] < sources[j]
+	})
+
+	listed := make([]string, 0)
+	for _, source := range sources {
+		if float64(rs.sources[source].count) >= float64(total)*sourceShareThreshold {
+			listed = append(listed, source)
+		}
+	}
+
+	return listed
+}
+
+// Vantage returns the candidate vantage point, the most common source
+// address, or the empty string if no sources were seen.
+func (rs *RawSummary) Vantage() string {
+	if sources := rs.SourceAddresses(); len(sources) > 0 {
+		return sources[0]
+	}
+	return ""
+}
+
+// DstPorts returns the destination ports seen from the candidate vantage
+// point, in ascending order.
+func (rs *RawSummary) DstPorts() []int {
+	ports := make([]int, 0)
+
+	if ss, ok := rs.sources[rs.Vantage()]; ok {
+		for port := range ss.ports {
+			ports = append(ports, port)
+		}
+	}
+
+	sort.Ints(ports)
+	return ports
+}
+
+// Metadata returns the inferred characteristics as raw metadata keys.
+func (rs *RawSummary) Metadata() map[string]interface{} {
+	out := make(map[string]interface{})
+	out["_file_type"] = rs.Filetype()
+	out["record_count"] = strconv.Itoa(rs.RecordCount)
+
+	if !rs.TimeStart.IsZero() {
+		out["_time_start"] = rs.TimeStart.UTC().Format(time.RFC3339)
+		out["_time_end"] = rs.TimeEnd.UTC().Format(time.RFC3339)
+	}
+
+	if sources := rs.SourceAddresses(); len(sources) > 0 {
+		out["source_addresses"] = sources
+		out["vantage"] = sources[0]
+
+		// as a port list the normalizers read
+		ports := make([]string, 0)
+		for _, port := range rs.DstPorts() {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		out["dst_port"] = strings.Join(ports, ",")
+	}
+
+	return out
+}
+
+// SniffFiletype determines the base filetype of decompressed raw data from
+// its first few bytes, or its first record for NDJSON. The reader must be
+// able to buffer at least 1MB.
+func SniffFiletype(br *bufio.Reader) (string, error) {
+	head, err := br.Peek(sniffBufferSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+
+	if bytes.HasPrefix(head, pcapngMagic) {
+		return FiletypePcapng, nil
+	}
+
+	for _, magic := range pcapMagics {
+		if bytes.HasPrefix(head, magic) {
+			return FiletypePcap, nil
+		}
+	}
+
+	if bytes.HasPrefix(head, ipfixVersion) {
+		return FiletypeQoF, nil
+	}
+
+	// look for the first NDJSON record
+	for _, line := range bytes.Split(head, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+
+		var rec map[string]json.RawMessage
+		if err := json.Unmarshal(line, &rec); err != nil {
+			break
+		}
+
+		if _, ok := rec["path"]; ok {
+			return FiletypePathspiderV2, nil
+		}
+		if _, ok := rec["dip"]; ok {
+			return FiletypePathspiderV1, nil
+		}
+		break
+	}
+
+	return "", fmt.Errorf("cannot determine filetype")
+}
+
+// jsonTimestamp returns a timestamp in a PathSpider record as a string, for
+// the timestamp parser; it may be a string or a number.
+func jsonTimestamp(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+type psRecord struct {
+	Time struct {
+		From json.RawMessage `json:"from"`
+		To   json.RawMessage `json:"to"`
+	} `json:"time"`
+	Sip  string   `json:"sip"`
+	Path []string `json:"path"`
+	Dp   *int     `json:"dp"`
+}
+
+func (rs *RawSummary) scanPathspider(in io.Reader, tp *TimestampParser) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), sniffBufferSize)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+
+		rs.RecordCount++
+
+		var rec psRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			rs.MalformedCount++
+			continue
+		}
+
+		start, err := tp.Parse(jsonTimestamp(rec.Time.From))
+		if err != nil {
+			rs.MalformedCount++
+			continue
+		}
+		end, err := tp.Parse(jsonTimestamp(rec.Time.To))
+		if err != nil {
+			rs.MalformedCount++
+			continue
+		}
+		rs.addTime(start, end)
+
+		port := -1
+		if rec.Dp != nil {
+			port = *rec.Dp
+		}
+
+		if len(rec.Path) > 0 {
+			rs.addSource(rec.Path[0], port)
+		} else if rec.Sip != "" {
+			rs.addSource(rec.Sip, port)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (rs *RawSummary) scanIPFIX(in io.Reader) error {
+	s := ipfix.NewSession()
+	i := ipfix.NewInterpreter(s)
+
+	for {
+		msg, err := s.ParseReader(in)
+		if err != nil {
+			if err == io.EOF {
+				break
+			} else {
+				return err
+			}
+		}
+
+		for _, rec := range msg.DataRecords {
+			rs.RecordCount++
+
+			var start, end time.Time
+			var source string
+			port := -1
+
+			for _, field := range i.Interpret(rec) {
+				switch field.Name {
+				case "flowStartMilliseconds":
+					start, _ = field.Value.(time.Time)
+				case "flowEndMilliseconds":
+					end, _ = field.Value.(time.Time)
+				case "sourceIPv4Address", "sourceIPv6Address":
+					if ip, ok := field.Value.(*net.IP); ok {
+						source = ip.String()
+					}
+				case "destinationTransportPort":
+					if dp, ok := field.Value.(uint16); ok {
+						port = int(dp)
+					}
+				}
+			}
+
+			if !start.IsZero() {
+				if end.IsZero() {
+					end = start
+				}
+				rs.addTime(start, end)
+			}
+
+			if source != "" {
+				rs.addSource(source, port)
+			}
+		}
+	}
+
+	return nil
+}
+
+// packetReader is implemented by both the pcap and the pcapng readers
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// scanPcap counts packets; sources and destination ports are taken from
+// initial SYNs only, so that replies are not counted.
+func (rs *RawSummary) scanPcap(in io.Reader) error {
+	var pr packetReader
+	var err error
+	if rs.Basetype == FiletypePcapng {
+		pr, err = pcapgo.NewNgReader(in, pcapgo.DefaultNgReaderOptions)
+	} else {
+		pr, err = pcapgo.NewReader(in)
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		data, ci, err := pr.ReadPacketData()
+		if err != nil {
+			if err == io.EOF {
+				break
+			} else {
+				return err
+			}
+		}
+
+		rs.RecordCount++
+		rs.addTime(ci.Timestamp, ci.Timestamp)
+
+		packet := gopacket.NewPacket(data, pr.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok || !tcp.SYN || tcp.ACK {
+			continue
+		}
+
+		if ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+			rs.addSource(ip4.SrcIP.String(), int(tcp.DstPort))
+		} else if ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+			rs.addSource(ip6.SrcIP.String(), int(tcp.DstPort))
+		}
+	}
+
+	return nil
+}
+
+// CodecSuffix returns the filetype suffix for a compression codec.
+func CodecSuffix(codec string) string {
+	for suffix, c := range CompressionSuffixes {
+		if c == codec {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// SummarizeRaw reads a raw data stream and summarizes its content. The
+// filetype and compression codec are detected from the content if filetype is
+// empty. Metadata is used to configure timestamp parsing.
+func SummarizeRaw(in io.Reader, filetype string, md *pto3.RawMetadata) (*RawSummary, error) {
+	rs := newRawSummary()
+
+	if filetype != "" {
+		rs.Basetype, rs.Codec = SplitFiletype(filetype)
+	}
+
+	if rs.Codec == CodecNone {
+		var err error
+		if in, rs.Codec, err = DetectCodec(in); err != nil {
+			return nil, fmt.Errorf("cannot read input: %s", err.Error())
+		}
+	}
+
+	r, err := Decompress(in, rs.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress input: %s", err.Error())
+	}
+
+	br := bufio.NewReaderSize(r, sniffBufferSize)
+
+	if rs.Basetype == "" {
+		if rs.Basetype, err = SniffFiletype(br); err != nil {
+			return nil, err
+		}
+	}
+
+	switch rs.Basetype {
+	case FiletypePathspiderV1, FiletypePathspiderV2:
+		var tp *TimestampParser
+		if tp, err = NewTimestampParser(md); err != nil {
+			return nil, err
+		}
+		err = rs.scanPathspider(br, tp)
+	case FiletypeQoF:
+		err = rs.scanIPFIX(br)
+	case FiletypePcap, FiletypePcapng:
+		err = rs.scanPcap(br)
+	default:
+		return nil, fmt.Errorf("unsupported filetype %s", rs.Basetype)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", rs.Basetype, err.Error())
+	}
+
+	return rs, nil
+}
@@ -0,0 +1,246 @@
+package ecn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/colinmarc/sequencefile"
+)
+
+// SequenceIndexSuffix is appended to the name of a SequenceFile to get the
+// name of its index.
+const SequenceIndexSuffix = ".idx"
+
+// syncEscape precedes each sync marker after the header of a SequenceFile
+var syncEscape = []byte{0xff, 0xff, 0xff, 0xff}
+
+// maxHeaderLength bounds the search for the end of a SequenceFile header
+const maxHeaderLength = 1 << 20
+
+// SequenceIndex maps the keys in a SequenceFile to the offset of the sync
+// marker preceding them, so entries can be read without scanning the whole
+// file. Entries can only be read from a sync point, so the header, which
+// readers need first, is located as well.
+type SequenceIndex struct {
+	HeaderLength int64            `json:"header_length"`
+	Offsets      map[string]int64 `json:"offsets"`
+}
+
+// headerLength returns the length of the header of a SequenceFile, which ends
+// with the first occurrence of its sync marker.
+func headerLength(rs io.ReadSeeker) (int64, []byte, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+
+	sf := sequencefile.NewReader(bufio.NewReader(rs))
+	if err := sf.ReadHeader(); err != nil {
+		return 0, nil, fmt.Errorf("cannot read sequence file header: %s", err.Error())
+	}
+	marker := sf.Header.SyncMarker
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+
+	head := make([]byte, maxHeaderLength)
+	n, err := io.ReadFull(rs, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, nil, err
+	}
+
+	i := bytes.Index(head[:n], marker)
+	if i < 0 {
+		return 0, nil, fmt.Errorf("cannot find end of sequence file header")
+	}
+
+	return int64(i + len(marker)), marker, nil
+}
+
+// findSyncs returns the offsets of all escaped sync markers in a stream.
+func findSyncs(r io.Reader, marker []byte, base int64) ([]int64, error) {
+	sync := append(append([]byte(nil), syncEscape...), marker...)
+
+	var out []int64
+	buf := make([]byte, 0, 1<<20+len(sync))
+	chunk := make([]byte, 1<<20)
+	offset := base
+
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		start := 0
+		for {
+			i := bytes.Index(buf[start:], sync)
+			if i < 0 {
+				break
+			}
+			out = append(out, offset+int64(start+i))
+			start += i + len(sync)
+		}
+
+		// keep enough of the end of the buffer to find a marker spanning reads
+		keep := len(sync) - 1
+		if len(buf)-start < keep {
+			keep = len(buf) - start
+		}
+		offset += int64(len(buf) - keep)
+		buf = append(buf[:0], buf[len(buf)-keep:]...)
+
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// segmentReader returns a SequenceFile reader for the entries between two
+// offsets, by prepending the header to them. An end of -1 reads to the end.
+func segmentReader(rs io.ReadSeeker, header []byte, start int64, end int64) (*sequencefile.Reader, error) {
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = rs
+	if end >= 0 {
+		body = io.LimitReader(rs, end-start)
+	}
+
+	sf := sequencefile.NewReader(io.MultiReader(bytes.NewReader(header), bufio.NewReader(body)))
+	if err := sf.ReadHeader(); err != nil {
+		return nil, fmt.Errorf("cannot read sequence file header: %s", err.Error())
+	}
+
+	return sf, nil
+}
+
+func readHeader(rs io.ReadSeeker, length int64) ([]byte, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, length)
+	if _, err := io.ReadFull(rs, header); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// BuildSequenceIndex indexes a SequenceFile. It reads the file twice: once to
+// find the sync markers, and once to find the keys following each.
+func BuildSequenceIndex(rs io.ReadSeeker) (*SequenceIndex, error) {
+	hlen, marker, err := headerLength(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readHeader(rs, hlen)
+	if err != nil {
+		return nil, err
+	}
+
+	syncs, err := findSyncs(bufio.NewReader(rs), marker, hlen)
+	if err != nil {
+		return nil, err
+	}
+
+	// entries before the first sync marker start right after the header
+	if len(syncs) == 0 || syncs[0] != hlen {
+		syncs = append([]int64{hlen}, syncs...)
+	}
+
+	si := &SequenceIndex{HeaderLength: hlen, Offsets: make(map[string]int64)}
+
+	for i, start := range syncs {
+		end := int64(-1)
+		if i+1 < len(syncs) {
+			end = syncs[i+1]
+		}
+
+		sf, err := segmentReader(rs, header, start, end)
+		if err != nil {
+			return nil, err
+		}
+
+		for sf.Scan() {
+			key := SequenceKey(sf)
+			if _, ok := si.Offsets[key]; !ok {
+				si.Offsets[key] = start
+			}
+		}
+		if err := sf.Err(); err != nil {
+			return nil, fmt.Errorf("error reading entries at offset %d: %s", start, err.Error())
+		}
+	}
+
+	return si, nil
+}
+
+// ReadSequenceIndex reads a SequenceFile index from a file.
+func ReadSequenceIndex(filename string) (*SequenceIndex, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	si := new(SequenceIndex)
+	if err := json.NewDecoder(f).Decode(si); err != nil {
+		return nil, fmt.Errorf("cannot parse sequence file index %s: %s", filename, err.Error())
+	}
+
+	return si, nil
+}
+
+// WriteFile writes a SequenceFile index to a file, replacing it atomically.
+func (si *SequenceIndex) WriteFile(filename string) error {
+	b, err := json.Marshal(si)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(filename, b)
+}
+
+// Keys returns the keys in the index, in the order of the sync points
+// preceding them, and by key within each sync point.
+func (si *SequenceIndex) Keys() []string {
+	keys := make([]string, 0, len(si.Offsets))
+	for k := range si.Offsets {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if si.Offsets[keys[i]] != si.Offsets[keys[j]] {
+			return si.Offsets[keys[i]] < si.Offsets[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+// Seek returns a reader positioned at the sync point preceding the entry with
+// the given key. The reader may return entries before the key, so callers
+// must still compare keys while scanning.
+func (si *SequenceIndex) Seek(rs io.ReadSeeker, key string) (*sequencefile.Reader, error) {
+	offset, ok := si.Offsets[key]
+	if !ok {
+		return nil, fmt.Errorf("missing sequence file entry %s", key)
+	}
+
+	header, err := readHeader(rs, si.HeaderLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return segmentReader(rs, header, offset, -1)
+}
@@ -0,0 +1,109 @@
+package ecn
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/colinmarc/sequencefile"
+)
+
+// testSequenceFile writes entries large enough to span several sync points,
+// and returns the file, the keys in the order written and their values.
+func testSequenceFile(t *testing.T) ([]byte, []string, map[string]string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	sw, err := sequencefile.NewWriter(&sequencefile.WriterOptions{
+		Writer:     &buf,
+		KeyClass:   sequencefile.TextClassName,
+		ValueClass: sequencefile.BytesWritableClassName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	values := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("campaign/entry-%02d.ndjson", i)
+		value := strings.Repeat(fmt.Sprintf("{\"entry\": %d}\n", i), 40)
+		if err := sw.Append(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		values[key] = value
+	}
+
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), keys, values
+}
+
+func TestSequenceIndexSeek(t *testing.T) {
+	b, keys, values := testSequenceFile(t)
+
+	si, err := BuildSequenceIndex(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := make(map[int64]struct{})
+	for _, offset := range si.Offsets {
+		offsets[offset] = struct{}{}
+	}
+	if len(offsets) < 2 {
+		t.Fatalf("expected several sync points, got %d", len(offsets))
+	}
+
+	if !reflect.DeepEqual(si.Keys(), keys) {
+		t.Errorf("index keys %v, want %v", si.Keys(), keys)
+	}
+
+	// the index survives a round trip through a file
+	dir, err := ioutil.TempDir("", "seqindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.seq"+SequenceIndexSuffix)
+	if err := si.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	si, err = ReadSequenceIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each entry can be read from its sync point, last first
+	for i := len(keys) - 1; i >= 0; i-- {
+		key := keys[i]
+
+		sf, err := si.Seek(bytes.NewReader(b), key)
+		if err != nil {
+			t.Fatalf("seeking to %s: %s", key, err.Error())
+		}
+
+		var out bytes.Buffer
+		if err := ExtractSequenceEntry(sf, key, &out); err != nil {
+			t.Fatalf("extracting %s: %s", key, err.Error())
+		}
+
+		if out.String() != values[key] {
+			t.Errorf("entry %s: got %d bytes, want %d", key, out.Len(), len(values[key]))
+		}
+	}
+
+	if _, err := si.Seek(bytes.NewReader(b), "missing"); err == nil {
+		t.Error("expected error seeking to missing key")
+	}
+}
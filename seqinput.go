@@ -0,0 +1,204 @@
+package ecn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/colinmarc/sequencefile"
+)
+
+// sequenceFileMagic starts every Hadoop SequenceFile, followed by a version
+var sequenceFileMagic = []byte("SEQ")
+
+// EntryMetadataSuffix is appended to the key of a SequenceFile entry to get
+// the key of the entry holding its metadata, if any.
+const EntryMetadataSuffix = ".meta.json"
+
+// NormalizeFunc normalizes a single raw data stream with its metadata.
+type NormalizeFunc func(in io.Reader, metain io.Reader, out io.Writer) error
+
+func decrapifySequenceKey(r rune) bool {
+	return unicode.IsControl(r) || unicode.IsSpace(r)
+}
+
+// unwrapWritable returns the content of a serialized SequenceFile key or
+// value of the given Hadoop writable class, without its length prefix.
+// Values of other classes are returned as they are.
+func unwrapWritable(class string, b []byte) []byte {
+	switch class {
+	case sequencefile.TextClassName:
+		return []byte(sequencefile.Text(b))
+	case sequencefile.BytesWritableClassName:
+		return sequencefile.BytesWritable(b)
+	default:
+		return b
+	}
+}
+
+// SequenceKey returns the key of the current entry in a SequenceFile as a
+// string. Text and BytesWritable keys are unwrapped; keys of other classes
+// are stripped of the control characters and padding around them.
+func SequenceKey(sf *sequencefile.Reader) string {
+	switch sf.Header.KeyClassName {
+	case sequencefile.TextClassName, sequencefile.BytesWritableClassName:
+		return string(unwrapWritable(sf.Header.KeyClassName, sf.Key()))
+	default:
+		return strings.TrimFunc(string(sf.Key()), decrapifySequenceKey)
+	}
+}
+
+// SequenceValue returns the value of the current entry in a SequenceFile,
+// unwrapped if it is a Text or BytesWritable.
+func SequenceValue(sf *sequencefile.Reader) []byte {
+	return unwrapWritable(sf.Header.ValueClassName, sf.Value())
+}
+
+// ExtractSequenceEntry finds the entry with the given key in a SequenceFile
+// and writes its value to out.
+func ExtractSequenceEntry(sf *sequencefile.Reader, key string, out io.Writer) error {
+	for sf.Scan() {
+		if SequenceKey(sf) == key {
+			_, err := out.Write(SequenceValue(sf))
+			return err
+		}
+	}
+	if err := sf.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("missing sequence file entry %s", key)
+}
+
+// entryMetadata builds the metadata for a SequenceFile entry: the metadata of
+// the container, overridden by the entry's own metadata if any, and the key of
+// the entry as sequencefile_key.
+func entryMetadata(container map[string]interface{}, entry []byte, key string) ([]byte, error) {
+	md := make(map[string]interface{})
+	for k, v := range container {
+		md[k] = v
+	}
+
+	if entry != nil {
+		entrymd := make(map[string]interface{})
+		if err := json.Unmarshal(entry, &entrymd); err != nil {
+			return nil, fmt.Errorf("cannot parse metadata for entry %s: %s", key, err.Error())
+		}
+		for k, v := range entrymd {
+			md[k] = v
+		}
+	}
+
+	md["sequencefile_key"] = key
+
+	return json.Marshal(md)
+}
+
+// NormalizeInput runs a normalizer on its input, which may be a Hadoop
+// SequenceFile containing raw data files instead of raw data itself. The
+// sequencefile_key metadata key selects the entry to normalize, since each
+// run of a normalizer must yield a single observation set. An entry's
+// metadata may be given in an entry with the same key and the suffix
+// .meta.json, which must precede it. If the sequencefile_index metadata key
+// names an index for the SequenceFile and the input is a file, the selected
+// entry is read directly instead of scanning for it.
+func NormalizeInput(in io.Reader, metain io.Reader, out io.Writer, normalize NormalizeFunc) error {
+	// buffer container metadata, we need it for each entry
+	mdbytes, err := ioutil.ReadAll(metain)
+	if err != nil {
+		return fmt.Errorf("could not read metadata: %s", err.Error())
+	}
+
+	container := make(map[string]interface{})
+	if err := json.Unmarshal(mdbytes, &container); err != nil {
+		return fmt.Errorf("could not read metadata: %s", err.Error())
+	}
+
+	selected, _ := container["sequencefile_key"].(string)
+	indexfile, _ := container["sequencefile_index"].(string)
+
+	// seek to the selected entry if we can
+	if rs, ok := in.(io.ReadSeeker); ok && selected != "" && indexfile != "" {
+		if _, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			si, err := ReadSequenceIndex(indexfile)
+			if err != nil {
+				return err
+			}
+
+			// start at the entry metadata if there is any
+			key := selected
+			if _, ok := si.Offsets[selected+EntryMetadataSuffix]; ok {
+				key = selected + EntryMetadataSuffix
+			}
+
+			sf, err := si.Seek(rs, key)
+			if err != nil {
+				return err
+			}
+
+			return normalizeEntries(sf, container, selected, out, normalize)
+		}
+	}
+
+	br := bufio.NewReader(in)
+
+	magic, err := br.Peek(len(sequenceFileMagic))
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("cannot read input: %s", err.Error())
+	}
+
+	if !bytes.Equal(magic, sequenceFileMagic) {
+		return normalize(br, bytes.NewReader(mdbytes), out)
+	}
+
+	if selected == "" {
+		return fmt.Errorf("sequence file input requires sequencefile_key to select an entry")
+	}
+
+	sf := sequencefile.NewReader(br)
+	if err := sf.ReadHeader(); err != nil {
+		return fmt.Errorf("cannot read sequence file header: %s", err.Error())
+	}
+
+	return normalizeEntries(sf, container, selected, out, normalize)
+}
+
+// normalizeEntries normalizes the selected entry from a SequenceFile.
+func normalizeEntries(sf *sequencefile.Reader, container map[string]interface{}, selected string, out io.Writer, normalize NormalizeFunc) error {
+	entrymd := make(map[string][]byte)
+
+	for sf.Scan() {
+		key := SequenceKey(sf)
+
+		// keep entry metadata until we get to the entry
+		if strings.HasSuffix(key, EntryMetadataSuffix) {
+			entrymd[strings.TrimSuffix(key, EntryMetadataSuffix)] = append([]byte(nil), SequenceValue(sf)...)
+			continue
+		}
+
+		if key != selected {
+			continue
+		}
+
+		md, err := entryMetadata(container, entrymd[key], key)
+		if err != nil {
+			return err
+		}
+
+		if err := normalize(bytes.NewReader(SequenceValue(sf)), bytes.NewReader(md), out); err != nil {
+			return fmt.Errorf("error normalizing entry %s: %s", key, err.Error())
+		}
+
+		return nil
+	}
+
+	if err := sf.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("missing sequence file entry %s", selected)
+}
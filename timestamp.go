@@ -0,0 +1,95 @@
+package ecn
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// zonedTimestampFormats carry their own offset from UTC
+var zonedTimestampFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05Z0700",
+}
+
+// localTimestampFormats are interpreted in the parser's time zone. Fractional
+// seconds are accepted after the seconds field of each.
+var localTimestampFormats = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// epochMillisecondsThreshold separates Unix timestamps in seconds from those
+// in milliseconds; it is in the year 5138 as seconds, and 1973 as
+// milliseconds.
+const epochMillisecondsThreshold = 1e11
+
+// TimestampParser parses timestamps in raw data, in any of the formats used
+// by the various measurement tools, and returns them in UTC.
+type TimestampParser struct {
+	loc *time.Location
+}
+
+// NewTimestampParser creates a timestamp parser, reading the time zone used
+// for timestamps without an explicit offset from the timezone key in raw
+// metadata. The time zone defaults to UTC.
+func NewTimestampParser(md *pto3.RawMetadata) (*TimestampParser, error) {
+	tp := new(TimestampParser)
+	tp.loc = time.UTC
+
+	if tz := md.Get("timezone", true); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("bad timezone %s: %s", tz, err.Error())
+		}
+		tp.loc = loc
+	}
+
+	return tp, nil
+}
+
+// Parse parses a timestamp given as RFC 3339 or ISO 8601 with or without
+// offset, or as Unix epoch seconds or milliseconds.
+func (tp *TimestampParser) Parse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	// try epoch time first; integers are taken exactly, as float64 cannot
+	// hold every millisecond
+	if epoch, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if epoch > epochMillisecondsThreshold {
+			return time.UnixMilli(epoch).UTC(), nil
+		}
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+
+	// then decimal or exponent seconds, rounded to the microsecond, which is
+	// all a float64 holds for current times; ParseFloat also accepts NaN and
+	// Inf, which are not timestamps
+	if epoch, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(epoch) && !math.IsInf(epoch, 0) {
+		if epoch > epochMillisecondsThreshold {
+			epoch /= 1000
+		}
+		sec, frac := math.Modf(epoch)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e6))*1e3).UTC(), nil
+	}
+
+	for _, timefmt := range zonedTimestampFormats {
+		if t, err := time.Parse(timefmt, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	for _, timefmt := range localTimestampFormats {
+		if t, err := time.ParseInLocation(timefmt, s, tp.loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse timestamp %s", s)
+}
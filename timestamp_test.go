@@ -0,0 +1,75 @@
+package ecn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampParser(t *testing.T) {
+	tests := []struct {
+		metadata string
+		in       string
+		want     string // RFC 3339 in UTC, empty if the timestamp is invalid
+	}{
+		// epoch seconds and milliseconds
+		{`{}`, "1519862400", "2018-03-01T00:00:00Z"},
+		{`{}`, "1519862400.5", "2018-03-01T00:00:00.5Z"},
+		{`{}`, "1519862400500", "2018-03-01T00:00:00.5Z"},
+		{`{}`, "1519862400123", "2018-03-01T00:00:00.123Z"},
+		{`{}`, "1519862400001", "2018-03-01T00:00:00.001Z"},
+		{`{}`, "1519862400.123", "2018-03-01T00:00:00.123Z"},
+		{`{}`, "1519862400.000001", "2018-03-01T00:00:00.000001Z"},
+		{`{}`, "1519862400123.0", "2018-03-01T00:00:00.123Z"},
+		{`{}`, "1e5", "1970-01-02T03:46:40Z"},
+		{`{}`, "1.5198624e9", "2018-03-01T00:00:00Z"},
+		{`{}`, " 1519862400 ", "2018-03-01T00:00:00Z"},
+
+		// RFC 3339 and ISO 8601 with offset
+		{`{}`, "2018-03-01T01:00:00+01:00", "2018-03-01T00:00:00Z"},
+		{`{}`, "2018-03-01 00:00:00Z", "2018-03-01T00:00:00Z"},
+		{`{}`, "2018-03-01T01:00:00+0100", "2018-03-01T00:00:00Z"},
+		{`{}`, "2018-03-01 01:00:00.25+0100", "2018-03-01T00:00:00.25Z"},
+
+		// ISO 8601 without offset, in the metadata time zone
+		{`{}`, "2018-03-01 00:00:00", "2018-03-01T00:00:00Z"},
+		{`{}`, "2018-03-01T00:00:00.123456", "2018-03-01T00:00:00.123456Z"},
+		{`{"timezone": "Europe/Zurich"}`, "2018-03-01 01:00:00", "2018-03-01T00:00:00Z"},
+		{`{"timezone": "Europe/Zurich"}`, "2018-03-01T00:00:00Z", "2018-03-01T00:00:00Z"},
+
+		// not timestamps
+		{`{}`, "NaN", ""},
+		{`{}`, "Inf", ""},
+		{`{}`, "-Infinity", ""},
+		{`{}`, "", ""},
+		{`{}`, "yesterday", ""},
+		{`{}`, "2018-03-01", ""},
+	}
+
+	for _, test := range tests {
+		tp, err := NewTimestampParser(testMetadata(t, test.metadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := tp.Parse(test.in)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", test.in, got.Format(time.RFC3339Nano))
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%q: %s", test.in, err.Error())
+			continue
+		}
+
+		if got.Format(time.RFC3339Nano) != test.want {
+			t.Errorf("%q: got %s, want %s", test.in, got.Format(time.RFC3339Nano), test.want)
+		}
+	}
+}
+
+func TestTimestampParserBadTimezone(t *testing.T) {
+	if _, err := NewTimestampParser(testMetadata(t, `{"timezone": "Mars/Olympus_Mons"}`)); err == nil {
+		t.Error("expected error for unknown time zone")
+	}
+}
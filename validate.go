@@ -0,0 +1,261 @@
+package ecn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// Severities of validation problems. Errors are mismatches that make the
+// normalizer fail or produce wrong observations; warnings are suspicious.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// timeTolerance allows for metadata times truncated to the second
+const timeTolerance = time.Second
+
+// wideTimeRange is how much wider than the data a declared time range may be
+// before it is reported
+const wideTimeRange = 24 * time.Hour
+
+// equivalentFiletypes are base filetypes a normalizer reads interchangeably,
+// since it detects which it has from the content
+var equivalentFiletypes = map[string]string{
+	FiletypePcap:   FiletypePcapng,
+	FiletypePcapng: FiletypePcap,
+}
+
+// ValidationProblem is a single mismatch between raw metadata and the content
+// of a raw data file.
+type ValidationProblem struct {
+	Severity string `json:"severity"`
+	Key      string `json:"key"`
+	Message  string `json:"message"`
+}
+
+// ValidationReport is the result of validating raw metadata against the
+// content of a raw data file.
+type ValidationReport struct {
+	Valid    bool                   `json:"valid"`
+	Problems []ValidationProblem    `json:"problems"`
+	Inferred map[string]interface{} `json:"inferred"`
+}
+
+func (vr *ValidationReport) report(severity string, key string, format string, args ...interface{}) {
+	vr.Problems = append(vr.Problems, ValidationProblem{
+		Severity: severity,
+		Key:      key,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	if severity == SeverityError {
+		vr.Valid = false
+	}
+}
+
+func (vr *ValidationReport) checkFiletype(md *pto3.RawMetadata, rs *RawSummary, filetypes []string) {
+	declared := md.Filetype(true)
+	if declared == "" {
+		vr.report(SeverityError, "_file_type", "no filetype declared, content is %s", rs.Filetype())
+		return
+	}
+
+	basetype, codec := SplitFiletype(declared)
+
+	supported := false
+	for _, ft := range filetypes {
+		if basetype == ft {
+			supported = true
+		}
+	}
+	if !supported {
+		vr.report(SeverityError, "_file_type", "filetype %s not supported by this normalizer", declared)
+	}
+
+	if basetype != rs.Basetype {
+		if equivalentFiletypes[basetype] == rs.Basetype {
+			vr.report(SeverityWarning, "_file_type", "declared %s, content is %s", basetype, rs.Basetype)
+		} else {
+			vr.report(SeverityError, "_file_type", "declared %s, content is %s", basetype, rs.Basetype)
+		}
+	}
+
+	// without a suffix, compression is detected from the content
+	if codec != CodecNone && codec != rs.Codec {
+		vr.report(SeverityError, "_file_type", "declared %s compression, content is compressed with %q", codec, rs.Codec)
+	}
+}
+
+func (vr *ValidationReport) checkTimes(md *pto3.RawMetadata, rs *RawSummary) {
+	if rs.TimeStart.IsZero() {
+		vr.report(SeverityWarning, "_time_start", "no timestamps in data")
+		return
+	}
+
+	start := md.TimeStart(true)
+	end := md.TimeEnd(true)
+
+	if start == nil {
+		vr.report(SeverityError, "_time_start", "no start time declared")
+	} else if start.After(rs.TimeStart.Add(timeTolerance)) {
+		vr.report(SeverityError, "_time_start", "declared %s, data starts at %s",
+			start.UTC().Format(time.RFC3339), rs.TimeStart.UTC().Format(time.RFC3339))
+	} else if rs.TimeStart.Sub(*start) > wideTimeRange {
+		vr.report(SeverityWarning, "_time_start", "declared %s, data starts at %s",
+			start.UTC().Format(time.RFC3339), rs.TimeStart.UTC().Format(time.RFC3339))
+	}
+
+	if end == nil {
+		vr.report(SeverityError, "_time_end", "no end time declared")
+	} else if end.Add(timeTolerance).Before(rs.TimeEnd) {
+		vr.report(SeverityError, "_time_end", "declared %s, data ends at %s",
+			end.UTC().Format(time.RFC3339), rs.TimeEnd.UTC().Format(time.RFC3339))
+	} else if end.Sub(rs.TimeEnd) > wideTimeRange {
+		vr.report(SeverityWarning, "_time_end", "declared %s, data ends at %s",
+			end.UTC().Format(time.RFC3339), rs.TimeEnd.UTC().Format(time.RFC3339))
+	}
+}
+
+func (vr *ValidationReport) checkSources(md *pto3.RawMetadata, rs *RawSummary) {
+	sourceOverride := md.Get("source_override", true)
+	if sourceOverride == "" {
+		return
+	}
+
+	// only addresses can be compared with the data
+	addr, err := CanonicalAddress(sourceOverride)
+	if err != nil {
+		return
+	}
+
+	for _, source := range rs.SourceAddresses() {
+		if source == addr.String() {
+			return
+		}
+	}
+
+	vr.report(SeverityWarning, "source_override", "%s is not a source address in the data (most common is %s)",
+		sourceOverride, rs.Vantage())
+}
+
+func (vr *ValidationReport) checkPorts(md *pto3.RawMetadata, rs *RawSummary) {
+	portlist := md.Get("dst_port", true)
+	if portlist == "" {
+		return
+	}
+
+	ports, err := parsePortList(portlist)
+	if err != nil {
+		vr.report(SeverityError, "dst_port", "%s", err.Error())
+		return
+	}
+	if len(ports) == 0 {
+		return
+	}
+
+	seen := make(map[uint16]struct{})
+	for _, port := range rs.DstPorts() {
+		seen[uint16(port)] = struct{}{}
+	}
+
+	missing := 0
+	for port := range ports {
+		if _, ok := seen[port]; !ok {
+			vr.report(SeverityWarning, "dst_port", "port %d not seen in data", port)
+			missing++
+		}
+	}
+
+	// if no declared port is seen, there will be no observations at all
+	if missing == len(ports) && len(seen) > 0 {
+		vr.report(SeverityError, "dst_port", "none of %s seen in data", portlist)
+	}
+}
+
+func (vr *ValidationReport) checkCounts(md *pto3.RawMetadata, rs *RawSummary) {
+	if declared := md.Get("record_count", true); declared != "" {
+		if n, err := strconv.Atoi(declared); err != nil || n != rs.RecordCount {
+			vr.report(SeverityWarning, "record_count", "declared %s, data has %d records", declared, rs.RecordCount)
+		}
+	}
+
+	if rs.MalformedCount > 0 {
+		vr.report(SeverityWarning, "record_count", "%d of %d records malformed", rs.MalformedCount, rs.RecordCount)
+	}
+}
+
+// ValidateRaw checks raw metadata against the content of a raw data file: the
+// filetype and compression, the time range, the source override and the
+// destination ports. The filetypes are the base filetypes supported by the
+// normalizer doing the validation.
+func ValidateRaw(in io.Reader, md *pto3.RawMetadata, filetypes []string) (*ValidationReport, error) {
+	vr := new(ValidationReport)
+	vr.Valid = true
+	vr.Problems = make([]ValidationProblem, 0)
+
+	// read the content without trusting the declared filetype
+	rs, err := SummarizeRaw(in, "", md)
+	if err != nil {
+		vr.report(SeverityError, "_file_type", "cannot read content: %s", err.Error())
+		return vr, nil
+	}
+	vr.Inferred = rs.Metadata()
+
+	vr.checkFiletype(md, rs, filetypes)
+	vr.checkTimes(md, rs)
+	vr.checkSources(md, rs)
+	vr.checkPorts(md, rs)
+	vr.checkCounts(md, rs)
+
+	return vr, nil
+}
+
+// RunValidation implements the validate mode of a normalizer: it reads raw
+// data and metadata, and writes a validation report as JSON to out. It
+// returns false if the report contains errors.
+func RunValidation(in io.Reader, metain io.Reader, out io.Writer, filetypes []string) (bool, error) {
+	md, err := pto3.RawMetadataFromReader(metain, nil)
+	if err != nil {
+		return false, fmt.Errorf("could not read metadata: %s", err.Error())
+	}
+
+	vr, err := ValidateRaw(in, md, filetypes)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := json.MarshalIndent(vr, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := out.Write(append(b, '\n')); err != nil {
+		return false, err
+	}
+
+	return vr.Valid, nil
+}
+
+// ValidateInput runs RunValidation on the input of a normalizer, which may be
+// a SequenceFile as for NormalizeInput, so that the raw data of the selected
+// entry is checked against its own metadata.
+func ValidateInput(in io.Reader, metain io.Reader, out io.Writer, filetypes []string) (bool, error) {
+	valid := true
+
+	validate := func(in io.Reader, metain io.Reader, out io.Writer) error {
+		ok, err := RunValidation(in, metain, out, filetypes)
+		valid = valid && ok
+		return err
+	}
+
+	if err := NormalizeInput(in, metain, out, validate); err != nil {
+		return false, err
+	}
+
+	return valid, nil
+}